@@ -0,0 +1,157 @@
+package framework
+
+import (
+	"strings"
+	"time"
+
+	"github.com/openchirp/framework/rest"
+)
+
+const (
+	// reconnectDelay and reconnectMaxDelay bound the backoff between the
+	// reconnect attempts made when broker refreshes are enabled
+	reconnectDelay    = time.Second
+	reconnectMaxDelay = time.Minute
+)
+
+// WithBrokerRefresh re-fetches the broker settings after the given number of
+// consecutive failed reconnect attempts, so that a service whose broker was
+// moved server side does not keep trying the old address. For service
+// clients, the service node is re-fetched and the broker is discovered from
+// its properties again, otherwise the framework server's broker config is
+// re-fetched. If the broker changed, the MQTT client is replaced by one for
+// the new broker, which restores all subscriptions once it connects.
+//
+// Reconnecting is then done by the framework, with a backoff of up to one
+// minute between attempts, instead of by the MQTT client.
+// A broker given explicitly, as brokeruri or with WithBroker, is never
+// refreshed.
+func WithBrokerRefresh(failedReconnects int) ClientOption {
+	return func(c *Client) {
+		c.brokerRefreshAfter = failedReconnects
+	}
+}
+
+// startReconnect starts reconnect, unless it is already running or the
+// client is stopped
+func (c *Client) startReconnect() {
+	c.mqttLock.Lock()
+	defer c.mqttLock.Unlock()
+	if c.reconnectDone != nil || c.ctx.Err() != nil {
+		return
+	}
+	done := make(chan struct{})
+	c.reconnectDone = done
+	go func() {
+		defer close(done)
+		c.reconnect()
+		c.mqttLock.Lock()
+		c.reconnectDone = nil
+		c.mqttLock.Unlock()
+	}()
+}
+
+// reconnect reconnects a lost MQTT connection and refreshes the broker as
+// configured by WithBrokerRefresh. It returns once connected or once the
+// client is stopped.
+func (c *Client) reconnect() {
+	delay := reconnectDelay
+	maxDelay := reconnectMaxDelay
+	if c.maxReconnectInterval > 0 {
+		maxDelay = c.maxReconnectInterval
+	}
+	failures := 0
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if err := waitToken(c.ctx, c.mqttClient().Connect()); err == nil {
+			return
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+		if failures++; failures < c.brokerRefreshAfter || c.brokerRefresh == nil {
+			continue
+		}
+		failures = 0
+
+		brokeruri, err := c.brokerRefresh()
+		if err != nil {
+			c.logf("Failed to refresh the MQTT broker: %v", err)
+			continue
+		}
+		c.mqttLock.Lock()
+		if brokeruri != "" && brokeruri != c.brokerURI {
+			c.logf("Switching MQTT broker from %s to %s", c.brokerURI, brokeruri)
+			c.mqtt = c.newMQTTClient(brokeruri)
+			c.brokerURI = brokeruri
+			delay = reconnectDelay
+		}
+		c.mqttLock.Unlock()
+	}
+}
+
+// refetchBrokerConfig requests the framework server's broker config again
+// and returns its broker
+func (c *Client) refetchBrokerConfig() (string, error) {
+	config, err := c.host.RequestBrokerConfig()
+	if err != nil {
+		return "", err
+	}
+	c.mqttLock.Lock()
+	c.brokerConfig = &config
+	c.mqttLock.Unlock()
+	return config.URI, nil
+}
+
+// refreshServiceBroker re-fetches the service node and discovers the broker
+// from its properties again, falling back to the framework server's broker
+// config
+func (c *ServiceClient) refreshServiceBroker() (string, error) {
+	node, err := c.refreshServiceInfo()
+	if err != nil {
+		return "", err
+	}
+
+	config, err := serviceBrokerConfig(node)
+	if err != nil {
+		return "", err
+	}
+	if config == nil {
+		serverConfig, err := c.host.RequestBrokerConfig()
+		if err != nil {
+			return "", err
+		}
+		config = &serverConfig
+	}
+	c.mqttLock.Lock()
+	c.brokerConfig = config
+	c.mqttLock.Unlock()
+	return config.URI, nil
+}
+
+// serviceBrokerConfig returns the broker set by the service's MQTTBroker,
+// MQTTUser, and MQTTPass properties, or nil if no broker is set
+func serviceBrokerConfig(node rest.ServiceNode) (*rest.BrokerConfig, error) {
+	if node.Properties[rest.PropertyMQTTBroker] == "" {
+		// Half of the credentials are most likely a typo, that should not
+		// quietly fall back to the framework server's broker
+		return nil, node.CheckMQTTCredentials()
+	}
+	if err := node.ValidateMQTTProperties(); err != nil {
+		return nil, err
+	}
+	broker := node.Properties[rest.PropertyMQTTBroker]
+	if !strings.Contains(broker, "://") {
+		broker = "tcp://" + broker // a plain host:port implies tcp
+	}
+	return &rest.BrokerConfig{
+		URI:  broker,
+		User: node.Properties[rest.PropertyMQTTUser],
+		Pass: node.Properties[rest.PropertyMQTTPass],
+	}, nil
+}
@@ -7,12 +7,20 @@
 package framework
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
-	"math/big"
+	"sort"
+	"sync"
+	"time"
 
 	CRAND "crypto/rand"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/groupcache/lru"
 	"github.com/openchirp/framework/rest"
 )
 
@@ -20,8 +28,36 @@ const (
 	mqttAutoReconnect      = true
 	mqttQoS           byte = 2
 	mqttRetained           = false
+	// defaultClientIDPrefix is the MQTT client id prefix used when no
+	// WithClientIDPrefix option is given
+	defaultClientIDPrefix = "client"
+	// defaultDeviceUpdatesQoS is the QoS used for the service device updates
+	// subscription, so that link/unlink events are not lost
+	defaultDeviceUpdatesQoS byte = 1
+	// defaultDuplicateFilterSize is the number of message ids remembered by
+	// WithDuplicateFilter when the given size is not positive
+	defaultDuplicateFilterSize = 1024
 )
 
+// ErrNoBroker is returned when no MQTT broker was given and the framework
+// server did not provide one either
+var ErrNoBroker = errors.New("No MQTT broker given or provided by the framework server")
+
+// ErrInvalidQoS is returned when a QoS other than 0, 1, or 2 is given
+var ErrInvalidQoS = errors.New("Invalid MQTT QoS, it must be 0, 1, or 2")
+
+// WithBroker explicitly sets the MQTT broker and its credentials, as an
+// alternative to the brokeruri argument of the Start functions. If user is
+// empty, the client's id and token are used as the broker credentials.
+// The broker is otherwise discovered from the service's MQTTBroker property
+// (for service clients) and then from the framework server's broker config.
+func WithBroker(uri, user, pass string) ClientOption {
+	return func(c *Client) {
+		c.brokerConfig = &rest.BrokerConfig{URI: uri, User: user, Pass: pass}
+		c.brokerFixed = true
+	}
+}
+
 // ClientTopicHandler is a function prototype for a subscribed topic callback
 type ClientTopicHandler func(topic string, payload []byte)
 
@@ -33,15 +69,197 @@ type Client struct {
 	willTopic   string
 	willPayload []byte
 	mqtt        MQTT.Client
+	// mqttLock guards mqtt, brokerConfig, brokerURI, and reconnectDone,
+	// which change on a broker refresh
+	mqttLock sync.RWMutex
+	subsLock sync.Mutex
+	subs     map[string]subscription
+	// clientIDPrefix is prepended to the random part of the MQTT client id
+	clientIDPrefix string
+	// deviceUpdatesQoS is the QoS of the service device updates subscription
+	deviceUpdatesQoS byte
+	// serviceInfoAttempts and serviceInfoBackoff bound the retries of the
+	// service info request at service start
+	serviceInfoAttempts int
+	serviceInfoBackoff  time.Duration
+	// brokerConfig is the broker given by WithBroker or caches the
+	// discovered broker config, when no broker uri was given
+	brokerConfig *rest.BrokerConfig
+	// brokerFixed is set if the broker was given by WithBroker, so it is
+	// never refreshed
+	brokerFixed bool
+	// brokerURI is the broker that the MQTT client connects to
+	brokerURI string
+	// brokerRefreshAfter is the number of failed reconnects after which the
+	// broker is refreshed with brokerRefresh, if enabled
+	brokerRefreshAfter int
+	brokerRefresh      func() (string, error)
+	// reconnectDone is set while reconnect runs and is closed once it exits
+	reconnectDone chan struct{}
+	// dups drops redelivered messages, if enabled by WithDuplicateFilter
+	dups *dupFilter
+	// codec encodes and decodes payloads for PublishEncoded/SubscribeDecoded
+	codec Codec
+	// offlineStatus is published as retained service status on StopClient
+	offlineStatus string
+	// logger is the internal logger, if configured, and is guarded by
+	// loggerLock, since SetLogger may replace it while running
+	loggerLock sync.RWMutex
+	logger     *log.Logger
+	// qos is the default QoS of subscriptions and publishes
+	qos byte
+	// foldKeys makes property lookups case-insensitive
+	foldKeys bool
+	// updatesWatchdog detects a stalled device updates consumer, if set
+	updatesWatchdog      time.Duration
+	updatesStalledAction StalledUpdatesAction
+	updatesOnStall       func()
+	// updatesFilter selects the devices whose updates are delivered, if set
+	updatesFilter func(config map[string]string) bool
+	// pendingLock guards pending, the publishes that Close flushes
+	pendingLock sync.Mutex
+	pending     map[MQTT.Token]struct{}
+	// closeTimeout bounds flushing and unsubscribing on Close
+	closeTimeout time.Duration
+	// tlsConfig is used for brokers that connect over TLS, and is loaded
+	// from tlsFiles at start, if set
+	tlsConfig   *tls.Config
+	tlsFiles    *tlsFiles
+	tlsInsecure bool
+	// autoReconnect enables reconnecting a lost connection, with at most
+	// maxReconnectInterval between attempts, if set
+	autoReconnect        bool
+	maxReconnectInterval time.Duration
+	// hooksLock guards the OnReconnect and OnConnectionLost callbacks
+	hooksLock            sync.RWMutex
+	onReconnectHook      func()
+	onConnectionLostHook func(error)
+	// stats tracks the MQTT connection stability
+	statsLock sync.Mutex
+	stats     ConnectionStats
+	// stopped is set by the first stop of the client, under stopLock
+	stopLock sync.Mutex
+	stopped  bool
+	// ctx lives as long as the client and is canceled by stopClient
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// genClientID generates a random client id for mqtt
-func (c Client) genClientID() string {
-	r, err := CRAND.Int(CRAND.Reader, new(big.Int).SetInt64(100000))
-	if err != nil {
+// ConnectionStats describes the stability of a client's MQTT connection
+type ConnectionStats struct {
+	// Connected indicates if the connection is currently up
+	Connected bool
+	// Reconnects counts the connections made after the initial one
+	Reconnects int
+	// LastConnect is the time of the most recent (re)connect
+	LastConnect time.Time
+	// LastDisconnect is the time the connection was most recently lost
+	LastDisconnect time.Time
+	// Downtime is the total time spent disconnected after a lost connection,
+	// including the current outage
+	Downtime time.Duration
+}
+
+// ClientOption configures optional client behavior when starting a client
+type ClientOption func(*Client)
+
+// WithClientIDPrefix sets the prefix of the generated MQTT client id.
+// The prefix is followed by 16 random hex digits, which represent a 64-bit
+// random value. Keep in mind that some brokers only accept client ids of up
+// to 23 characters, which leaves 7 characters for the prefix.
+func WithClientIDPrefix(prefix string) ClientOption {
+	return func(c *Client) {
+		c.clientIDPrefix = prefix
+	}
+}
+
+// WithDeviceUpdatesQoS sets the QoS used to subscribe to the service's
+// device updates (link, unlink, and config change events). It only applies
+// to service clients and does not affect the QoS of any other subscription.
+// The default is QoS 1.
+func WithDeviceUpdatesQoS(qos byte) ClientOption {
+	return func(c *Client) {
+		c.deviceUpdatesQoS = qos
+	}
+}
+
+// WithDuplicateFilter drops redelivered QoS 1 and 2 messages before they are
+// dispatched to subscription callbacks. The ids of the last size messages
+// received are remembered, and a message marked as a duplicate (DUP flag)
+// with a remembered id is dropped. A size of 0 or less remembers the default
+// of 1024 messages.
+//
+// This gives effectively-once processing for idempotent handlers when the
+// broker redelivers messages, like after a reconnect.
+func WithDuplicateFilter(size int) ClientOption {
+	return func(c *Client) {
+		if size <= 0 {
+			// an lru.Cache of size 0 is unbounded
+			size = defaultDuplicateFilterSize
+		}
+		c.dups = &dupFilter{seen: lru.New(size)}
+	}
+}
+
+// dupFilter remembers the ids of recently received messages
+type dupFilter struct {
+	lock sync.Mutex
+	seen *lru.Cache
+}
+
+type dupFilterKey struct {
+	topic string
+	id    uint16
+}
+
+// isDuplicate records the message and reports whether it is a redelivery of
+// a recently received message
+func (f *dupFilter) isDuplicate(message MQTT.Message) bool {
+	if message.Qos() == 0 {
+		// QoS 0 messages are never redelivered and have no id
+		return false
+	}
+	key := dupFilterKey{topic: message.Topic(), id: message.MessageID()}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.seen.Get(key); ok && message.Duplicate() {
+		return true
+	}
+	f.seen.Add(key, nil)
+	return false
+}
+
+// applyOptions sets the option defaults and then applies the given options
+func (c *Client) applyOptions(opts []ClientOption) {
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.clientIDPrefix = defaultClientIDPrefix
+	c.deviceUpdatesQoS = defaultDeviceUpdatesQoS
+	c.serviceInfoAttempts = 1
+	c.codec = JSONCodec{}
+	c.qos = byte(mqttQos)
+	c.closeTimeout = defaultCloseTimeout
+	c.autoReconnect = mqttAutoReconnect
+	for _, opt := range opts {
+		opt(c)
+	}
+}
+
+// subscription holds the original parameters of an active subscription, so
+// that it can be restored exactly after a reconnect
+type subscription struct {
+	qos      byte
+	callback MQTT.MessageHandler
+}
+
+// genClientID generates a random client id for mqtt. The id is the client
+// id prefix followed by a 64-bit random value, in order to make collisions
+// between many clients on the same broker unlikely.
+func (c *Client) genClientID() string {
+	var r uint64
+	if err := binary.Read(CRAND.Reader, binary.BigEndian, &r); err != nil {
 		log.Fatal("Couldn't generate a random number for MQTT client ID")
 	}
-	return "client" + r.String()
+	return fmt.Sprintf("%s%016x", c.clientIDPrefix, r)
 }
 
 // setAuth sets basic client authentication parameters
@@ -111,26 +329,92 @@ func (c *Client) setWill(topic string, payload []byte) {
 		                 the ConnectionLostHandler is still called
 */
 func (c *Client) startMQTT(brokeruri string) error {
-	/* Connect the MQTT connection */
+	if err := c.loadTLSConfig(); err != nil {
+		return err
+	}
+	if brokeruri == "" {
+		config, err := c.fetchBrokerConfig()
+		if err != nil {
+			return fmt.Errorf("%w (broker config request failed: %v)", ErrNoBroker, err)
+		}
+		if config.URI == "" {
+			return ErrNoBroker
+		}
+		brokeruri = config.URI
+		if !c.brokerFixed && c.brokerRefresh == nil {
+			c.brokerRefresh = c.refetchBrokerConfig
+		}
+	}
+
+	/* Create and start a client using the above ClientOptions */
+	c.mqttLock.Lock()
+	client := c.newMQTTClient(brokeruri)
+	c.mqtt = client
+	c.brokerURI = brokeruri
+	c.mqttLock.Unlock()
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// newMQTTClient creates an MQTT client for the given broker with the client's
+// credentials and handlers. The caller must hold mqttLock.
+func (c *Client) newMQTTClient(brokeruri string) MQTT.Client {
 	opts := MQTT.NewClientOptions().AddBroker(brokeruri)
 	opts.SetClientID(c.genClientID())
-	opts.SetUsername(c.id).SetPassword(c.token)
-	opts.SetAutoReconnect(mqttAutoReconnect)
+	if c.brokerConfig != nil && c.brokerConfig.User != "" {
+		opts.SetUsername(c.brokerConfig.User).SetPassword(c.brokerConfig.Pass)
+	} else {
+		opts.SetUsername(c.id).SetPassword(c.token)
+	}
+	// with broker refreshes, reconnecting is done by reconnect instead
+	opts.SetAutoReconnect(c.autoReconnect && c.brokerRefreshAfter <= 0)
+	if c.maxReconnectInterval > 0 {
+		opts.SetMaxReconnectInterval(c.maxReconnectInterval)
+	}
+	opts.SetOnConnectHandler(c.onConnect)
+	opts.SetConnectionLostHandler(c.onConnectionLost)
+	if c.tlsConfig != nil && isTLSBroker(brokeruri) {
+		opts.SetTLSConfig(c.tlsConfig)
+	}
 	if c.willTopic != "" {
 		opts.SetBinaryWill(c.willTopic, c.willPayload, mqttQoS, mqttRetained)
 	}
+	return MQTT.NewClient(opts)
+}
 
-	/* Create and start a client using the above ClientOptions */
-	c.mqtt = MQTT.NewClient(opts)
-	if token := c.mqtt.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
+// mqttClient returns the current MQTT client
+func (c *Client) mqttClient() MQTT.Client {
+	c.mqttLock.RLock()
+	defer c.mqttLock.RUnlock()
+	return c.mqtt
+}
+
+// fetchBrokerConfig returns the broker given by WithBroker or discovered
+// earlier, or else requests the broker config from the framework server and
+// caches it for future connects
+func (c *Client) fetchBrokerConfig() (rest.BrokerConfig, error) {
+	c.mqttLock.RLock()
+	cached := c.brokerConfig
+	c.mqttLock.RUnlock()
+	if cached != nil {
+		return *cached, nil
 	}
-	return nil
+	config, err := c.host.RequestBrokerConfig()
+	if err != nil {
+		return config, err
+	}
+	c.mqttLock.Lock()
+	c.brokerConfig = &config
+	c.mqttLock.Unlock()
+	return config, nil
 }
 
 // startClient sets auth, starts REST, and starts MQTT
-func (c *Client) startClient(frameworkuri, brokeruri, id, token string) error {
+func (c *Client) startClient(frameworkuri, brokeruri, id, token string, opts []ClientOption) error {
 	/* Setup basic client parameters */
+	c.applyOptions(opts)
 	c.setAuth(id, token)
 
 	/* Setup the REST interface */
@@ -142,30 +426,234 @@ func (c *Client) startClient(frameworkuri, brokeruri, id, token string) error {
 	return c.startMQTT(brokeruri)
 }
 
-// stopService shuts down a started client
+// stopClient shuts down a started client.
+// It is safe to call even if MQTT was never started or never connected.
 func (c *Client) stopClient() {
-	c.mqtt.Disconnect(0)
+	c.disconnect(0)
+}
+
+// disconnect stops the client and disconnects from the broker, giving the
+// MQTT client quiesce milliseconds to finish its work
+func (c *Client) disconnect(quiesce uint) {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	// the reconnect loop must not connect or replace the client after it
+	// was disconnected
+	c.mqttLock.RLock()
+	reconnectDone := c.reconnectDone
+	c.mqttLock.RUnlock()
+	if reconnectDone != nil {
+		<-reconnectDone
+	}
+	// Disconnecting is also required while not connected, since it stops
+	// the MQTT client's own reconnecting
+	if client := c.mqttClient(); client != nil {
+		client.Disconnect(quiesce)
+	}
+}
+
+// onConnect restores all tracked subscriptions, since a clean session
+// reconnect leaves the broker with no subscriptions for us
+func (c *Client) onConnect(client MQTT.Client) {
+	c.statsLock.Lock()
+	now := time.Now()
+	reconnect := !c.stats.LastConnect.IsZero()
+	if reconnect {
+		c.stats.Reconnects++
+		c.stats.Downtime += now.Sub(c.stats.LastDisconnect)
+	}
+	c.stats.LastConnect = now
+	c.stats.Connected = true
+	c.statsLock.Unlock()
+
+	c.subsLock.Lock()
+	subs := make(map[string]subscription, len(c.subs))
+	for topic, sub := range c.subs {
+		subs[topic] = sub
+	}
+	c.subsLock.Unlock()
+
+	for topic, sub := range subs {
+		token := client.Subscribe(topic, sub.qos, sub.callback)
+		if token.Wait() && token.Error() != nil {
+			c.logf("Failed to resubscribe to %s: %v", topic, token.Error())
+		}
+	}
+
+	if reconnect {
+		c.reconnected()
+	}
+}
+
+// onConnectionLost records the lost connection for ConnectionStats and calls
+// the OnConnectionLost callback
+func (c *Client) onConnectionLost(client MQTT.Client, err error) {
+	c.statsLock.Lock()
+	c.stats.LastDisconnect = time.Now()
+	c.stats.Connected = false
+	c.statsLock.Unlock()
+
+	c.connectionLost(err)
+
+	if c.autoReconnect && c.brokerRefreshAfter > 0 {
+		c.startReconnect()
+	}
+}
+
+// ConnectionStats reports how stable the MQTT connection has been, in terms
+// of reconnects and downtime since the client was started
+func (c *Client) ConnectionStats() ConnectionStats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	stats := c.stats
+	if !stats.Connected && !stats.LastDisconnect.IsZero() {
+		stats.Downtime += time.Since(stats.LastDisconnect)
+	}
+	return stats
 }
 
 // subscribe registers a callback for a receiving a given mqtt topic payload
 func (c *Client) subscribe(topic string, callback ClientTopicHandler) error {
-	token := c.mqtt.Subscribe(topic, byte(mqttQos), func(client MQTT.Client, message MQTT.Message) {
+	return c.subscribeQoS(topic, c.qos, callback)
+}
+
+// subscribeQoS registers a callback for a receiving a given mqtt topic payload
+// at the given qos
+func (c *Client) subscribeQoS(topic string, qos byte, callback ClientTopicHandler) error {
+	if qos > 2 {
+		return ErrInvalidQoS
+	}
+	return c.subscribeMessage(topic, qos, func(message MQTT.Message) {
 		callback(message.Topic(), message.Payload())
 	})
-	token.Wait()
-	return token.Error()
+}
+
+// subscribeMessage registers a callback for receiving full mqtt messages on a
+// given topic at the given qos. The subscription is tracked, so that it is
+// restored with the same qos after a reconnect.
+func (c *Client) subscribeMessage(topic string, qos byte, callback func(message MQTT.Message)) error {
+	return c.subscribeMessageCtx(context.Background(), topic, qos, callback)
+}
+
+// subscribeMessageCtx is like subscribeMessage, but stops waiting for the
+// subscribe to complete once ctx is done and returns ctx's error. The broker
+// may still complete the subscribe afterwards, so the caller should roll it
+// back with unsubscribe.
+func (c *Client) subscribeMessageCtx(ctx context.Context, topic string, qos byte, callback func(message MQTT.Message)) error {
+	handler := func(client MQTT.Client, message MQTT.Message) {
+		if c.dups != nil && c.dups.isDuplicate(message) {
+			return
+		}
+		callback(message)
+	}
+	token := c.mqttClient().Subscribe(topic, qos, handler)
+	if err := waitToken(ctx, token); err != nil {
+		return err
+	}
+	c.subsLock.Lock()
+	if c.subs == nil {
+		c.subs = make(map[string]subscription)
+	}
+	c.subs[topic] = subscription{qos: qos, callback: handler}
+	c.subsLock.Unlock()
+	return nil
+}
+
+// waitToken waits for token to complete and returns its error, or returns
+// ctx's error if ctx is done first
+func waitToken(ctx context.Context, token MQTT.Token) error {
+	if ctx.Done() == nil {
+		token.Wait()
+		return token.Error()
+	}
+	done := make(chan struct{})
+	go func() {
+		token.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// activeSubscriptions returns the sorted topics of all tracked subscriptions
+func (c *Client) activeSubscriptions() []string {
+	c.subsLock.Lock()
+	topics := make([]string, 0, len(c.subs))
+	for topic := range c.subs {
+		topics = append(topics, topic)
+	}
+	c.subsLock.Unlock()
+	sort.Strings(topics)
+	return topics
 }
 
 // unsubscribe deregisters a callback for a given mqtt topics
 func (c *Client) unsubscribe(topics ...string) error {
-	token := c.mqtt.Unsubscribe(topics...)
-	token.Wait()
-	return token.Error()
+	return c.unsubscribeCtx(context.Background(), topics...)
+}
+
+// unsubscribeCtx is like unsubscribe, but stops waiting for the unsubscribe
+// to complete once ctx is done and returns ctx's error
+func (c *Client) unsubscribeCtx(ctx context.Context, topics ...string) error {
+	c.subsLock.Lock()
+	for _, topic := range topics {
+		delete(c.subs, topic)
+	}
+	c.subsLock.Unlock()
+	return waitToken(ctx, c.mqttClient().Unsubscribe(topics...))
 }
 
 // publish publishes a payload to a given mqtt topic
 func (c *Client) publish(topic string, payload interface{}) error {
-	token := c.mqtt.Publish(topic, byte(mqttQos), mqttPersistence, payload)
+	return c.publishQoS(topic, c.qos, payload)
+}
+
+// publishQoS publishes a payload to a given mqtt topic at the given qos
+func (c *Client) publishQoS(topic string, qos byte, payload interface{}) error {
+	if qos > 2 {
+		return ErrInvalidQoS
+	}
+	if err := ValidatePublishTopic(topic); err != nil {
+		return err
+	}
+	token := c.mqttClient().Publish(topic, qos, mqttPersistence, payload)
+	token.Wait()
+	return token.Error()
+}
+
+// publishCallback publishes a payload to a given mqtt topic without waiting
+// for it to complete. The optional onComplete is called from a new goroutine
+// once the publish completes.
+func (c *Client) publishCallback(topic string, payload interface{}, onComplete func(error)) {
+	if err := ValidatePublishTopic(topic); err != nil {
+		if onComplete != nil {
+			go onComplete(err)
+		}
+		return
+	}
+	token := c.mqttClient().Publish(topic, c.qos, mqttPersistence, payload)
+	c.trackPublish(token)
+	go func() {
+		token.Wait()
+		c.untrackPublish(token)
+		if onComplete != nil {
+			onComplete(token.Error())
+		}
+	}()
+}
+
+// publishRetained publishes a payload to a given mqtt topic and asks the
+// broker to retain it for future subscribers
+func (c *Client) publishRetained(topic string, payload interface{}) error {
+	if err := ValidatePublishTopic(topic); err != nil {
+		return err
+	}
+	token := c.mqttClient().Publish(topic, c.qos, true, payload)
 	token.Wait()
 	return token.Error()
 }
@@ -0,0 +1,185 @@
+package framework
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// defaultCloseTimeout bounds flushing and unsubscribing on Close, when no
+	// WithCloseTimeout option is given
+	defaultCloseTimeout = 5 * time.Second
+	// closeQuiesce is the time in milliseconds that Close gives the MQTT
+	// client to finish its work before disconnecting
+	closeQuiesce = 250
+)
+
+// ErrFlushTimeout is returned by Close when pending publishes did not
+// complete within the close timeout
+var ErrFlushTimeout = errors.New("Timed out flushing pending publishes")
+
+// WithCloseTimeout sets how long Close waits for pending publishes to
+// complete and for the unsubscribes, each. The default is five seconds.
+func WithCloseTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.closeTimeout = timeout
+	}
+}
+
+// trackPublish remembers token as pending, until it completes, so that Close
+// can flush it
+func (c *Client) trackPublish(token MQTT.Token) {
+	c.pendingLock.Lock()
+	if c.pending == nil {
+		c.pending = make(map[MQTT.Token]struct{})
+	}
+	c.pending[token] = struct{}{}
+	c.pendingLock.Unlock()
+}
+
+// untrackPublish forgets a completed pending publish
+func (c *Client) untrackPublish(token MQTT.Token) {
+	c.pendingLock.Lock()
+	delete(c.pending, token)
+	c.pendingLock.Unlock()
+}
+
+// flushPublishes waits for the pending publishes to complete, or returns
+// ErrFlushTimeout after timeout
+func (c *Client) flushPublishes(timeout time.Duration) error {
+	c.pendingLock.Lock()
+	tokens := make([]MQTT.Token, 0, len(c.pending))
+	for token := range c.pending {
+		tokens = append(tokens, token)
+	}
+	c.pendingLock.Unlock()
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, token := range tokens {
+			token.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return ErrFlushTimeout
+	}
+}
+
+// unsubscribeAll removes all tracked subscriptions, waiting for at most
+// timeout
+func (c *Client) unsubscribeAll(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.unsubscribeAllCtx(ctx)
+}
+
+// unsubscribeAllCtx removes all tracked subscriptions, like unsubscribeCtx
+func (c *Client) unsubscribeAllCtx(ctx context.Context) error {
+	topics := c.activeSubscriptions()
+	if len(topics) == 0 {
+		return nil
+	}
+	return c.unsubscribeCtx(ctx, topics...)
+}
+
+// closeClient flushes the pending publishes and unsubscribes everything,
+// waiting for at most timeout each, and then disconnects, giving the MQTT
+// client quiesce milliseconds to finish its work. It returns the first
+// error, but always disconnects.
+func (c *Client) closeClient(timeout time.Duration, quiesce uint) error {
+	var firstErr error
+	if client := c.mqttClient(); client != nil && client.IsConnected() {
+		firstErr = c.flushPublishes(timeout)
+		if err := c.unsubscribeAll(timeout); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.disconnect(quiesce)
+	return firstErr
+}
+
+// beginStop reports whether the client is being stopped for the first time,
+// so that stopping twice is a no-op
+func (c *Client) beginStop() bool {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+	if c.stopped {
+		return false
+	}
+	c.stopped = true
+	return true
+}
+
+// Close gracefully shuts down a started service and reports the errors
+// encountered on the way, which makes it suitable for a deferred shutdown in
+// main. Unlike StopClient, it flushes the pending publishes, like those made
+// by PublishCallback, and unsubscribes everything before disconnecting.
+//
+// The shutdown happens in the following order:
+//  1. Device updates, property updates, and the heartbeat are stopped.
+//  2. The offline status is published, if set by WithOfflineStatus.
+//  3. Pending publishes are flushed, bounded by the close timeout.
+//  4. All subscriptions are removed, bounded by the close timeout.
+//  5. The client disconnects from the broker.
+//
+// All steps are attempted, even if one fails, and the first error is
+// returned. Like StopClient, it is safe to call on a nil or partially
+// started client, and calling it again, or after StopClient, does nothing.
+func (c *ServiceClient) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.stop(true, c.closeTimeout, closeQuiesce)
+}
+
+// StopClientGraceful shuts down a started service like Close, but gives the
+// shutdown the quiesce duration, instead of the close timeout, to flush the
+// pending publishes and to unsubscribe, each. The MQTT client is also given
+// the quiesce duration to finish its work when disconnecting, so that the
+// last publishes make it out to the broker.
+// Like StopClient, it is safe to call on a nil or partially started client,
+// and calling it again does nothing.
+func (c *ServiceClient) StopClientGraceful(quiesce time.Duration) error {
+	return c.stop(true, quiesce, uint(quiesce/time.Millisecond))
+}
+
+// stop shuts down the service in the order documented by Close. Unless
+// graceful, the pending publishes are not flushed and the client disconnects
+// without unsubscribing. Only the first call does anything.
+func (c *ServiceClient) stop(graceful bool, timeout time.Duration, quiesce uint) error {
+	if c == nil || !c.beginStop() {
+		return nil
+	}
+	// Stop consumers of device updates before the updates themselves, and
+	// both before disconnecting, so that no MQTT callback is left blocked
+	// delivering an update
+	if c.manager != nil {
+		c.manager.Stop()
+	}
+	c.StopDeviceUpdates()
+	c.StopPropertyUpdates()
+	c.StopHeartbeat()
+
+	var firstErr error
+	if client := c.mqttClient(); c.offlineStatus != "" && client != nil && client.IsConnected() {
+		firstErr = c.publishOfflineStatus()
+	}
+	if !graceful {
+		c.stopClient()
+		return firstErr
+	}
+	if err := c.closeClient(timeout, quiesce); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
@@ -0,0 +1,34 @@
+package framework
+
+import (
+	"encoding/json"
+)
+
+// Codec marshals and unmarshals pubsub payloads. It is used by
+// PublishEncoded and SubscribeDecoded, which allows services to standardize
+// on a wire format other than JSON, like protobuf or CBOR.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is the default Codec, which uses encoding/json
+type JSONCodec struct{}
+
+// Marshal encodes v as JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// WithCodec sets the Codec used by PublishEncoded and SubscribeDecoded.
+// The default is JSONCodec.
+func WithCodec(codec Codec) ClientOption {
+	return func(c *Client) {
+		c.codec = codec
+	}
+}
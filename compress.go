@@ -0,0 +1,74 @@
+package framework
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// gzipMagic starts every gzip stream, so it marks compressed payloads. Since
+// no valid JSON or UTF-8 text starts with it, uncompressed payloads are never
+// mistaken for compressed ones.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// IsCompressed tells if payload is gzip compressed, as published by
+// PublishCompressed
+func IsCompressed(payload []byte) bool {
+	return bytes.HasPrefix(payload, gzipMagic)
+}
+
+// Compress gzip compresses payload, as done by PublishCompressed
+func Compress(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress decompresses a payload compressed by Compress. Payloads that are
+// not compressed are returned as is.
+func Decompress(payload []byte) ([]byte, error) {
+	if !IsCompressed(payload) {
+		return payload, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// PublishCompressed gzip compresses payload and publishes it to a given mqtt
+// topic. The payload is marked by the gzip header, which allows consumers
+// that use SubscribeCompressed to also accept uncompressed payloads.
+func (c *ServiceClient) PublishCompressed(topic string, payload []byte) error {
+	compressed, err := Compress(payload)
+	if err != nil {
+		return err
+	}
+	return c.publish(topic, compressed)
+}
+
+// SubscribeCompressed registers a callback for receiving a given mqtt topic
+// payload, which decompresses payloads published by PublishCompressed.
+// Uncompressed payloads are passed to callback as is, so that publishers can
+// move to compression one at a time. Payloads that fail to decompress are
+// passed to onError, which can be nil, in which case they are dropped.
+func (c *ServiceClient) SubscribeCompressed(topic string, callback func(topic string, payload []byte), onError DecodeErrorHandler) error {
+	return c.subscribe(topic, func(topic string, payload []byte) {
+		decompressed, err := Decompress(payload)
+		if err != nil {
+			if onError != nil {
+				onError(topic, payload, err)
+			}
+			return
+		}
+		callback(topic, decompressed)
+	})
+}
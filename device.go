@@ -7,6 +7,9 @@ import (
 const (
 	// TransducerPrefix is the device subtopic prefix for loggable topics
 	TransducerPrefix = "transducer"
+	// TransducerAckSubtopic is appended to a transducer's topic to form the
+	// topic that a device acknowledges transducer commands on
+	TransducerAckSubtopic = "ack"
 )
 
 // DeviceClient represents the context for a single user device session
@@ -16,12 +19,12 @@ type DeviceClient struct {
 }
 
 // StartDeviceClient starts the device client management layer
-func StartDeviceClient(frameworkuri, brokeruri, id, token string) (*DeviceClient, error) {
+func StartDeviceClient(frameworkuri, brokeruri, id, token string, opts ...ClientOption) (*DeviceClient, error) {
 	var err error
 	c := new(DeviceClient)
 
 	// Start Client
-	err = c.startClient(frameworkuri, brokeruri, id, token)
+	err = c.startClient(frameworkuri, brokeruri, id, token, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -39,18 +42,18 @@ func (c *DeviceClient) StopClient() {
 
 // Subscribe registers a callback for receiving on a device subtopic
 func (c *DeviceClient) Subscribe(subtopic string, callback ClientTopicHandler) error {
-	return c.subscribe(c.node.Pubsub.Topic+"/"+subtopic, callback)
+	return c.subscribe(TopicJoin(c.node.Pubsub.Topic, subtopic), callback)
 }
 
 // Unsubscribe deregisters a callback for a given mqtt topics
 func (c *DeviceClient) Unsubscribe(subtopics ...string) error {
 	for i, subtopic := range subtopics {
-		subtopics[i] = c.node.Pubsub.Topic + "/" + subtopic
+		subtopics[i] = TopicJoin(c.node.Pubsub.Topic, subtopic)
 	}
 	return c.unsubscribe(subtopics...)
 }
 
 // Publish publishes a payload to a given mqtt topic
 func (c *DeviceClient) Publish(subtopic string, payload interface{}) error {
-	return c.publish(c.node.Pubsub.Topic+"/"+subtopic, payload)
+	return c.publish(TopicJoin(c.node.Pubsub.Topic, subtopic), payload)
 }
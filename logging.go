@@ -0,0 +1,88 @@
+package framework
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// LogTimestampRFC3339Micro is an RFC3339 timestamp layout with microseconds,
+// for use with WithLogTimestampFormat
+const LogTimestampRFC3339Micro = "2006-01-02T15:04:05.000000Z07:00"
+
+// timestampWriter prefixes every log line with the current time in a custom
+// layout, which the log package's flags can not express
+type timestampWriter struct {
+	w      io.Writer
+	layout string
+}
+
+func (tw timestampWriter) Write(p []byte) (int, error) {
+	line := make([]byte, 0, len(tw.layout)+1+len(p))
+	line = time.Now().AppendFormat(line, tw.layout)
+	line = append(line, ' ')
+	line = append(line, p...)
+	if _, err := tw.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WithLogFlags sets the log package flags of the client's internal logger,
+// which otherwise logs like the standard logger. For example, 0 omits the
+// timestamps, when the container runtime already adds them.
+func WithLogFlags(flags int) ClientOption {
+	return func(c *Client) {
+		c.logger = log.New(os.Stderr, "", flags)
+	}
+}
+
+// WithLogTimestampFormat makes the client's internal logger prefix every line
+// with a timestamp in the given time layout, like LogTimestampRFC3339Micro.
+// The log package's own timestamps are disabled.
+func WithLogTimestampFormat(layout string) ClientOption {
+	return func(c *Client) {
+		c.logger = log.New(timestampWriter{w: os.Stderr, layout: layout}, "", 0)
+	}
+}
+
+// WithLogger makes the client's internal logger log to logger, so that the
+// client's logs can be integrated with the application's logging.
+// A nil logger silences the client entirely.
+func WithLogger(logger *log.Logger) ClientOption {
+	return func(c *Client) {
+		c.logger = loggerOrDiscard(logger)
+	}
+}
+
+// SetLogger replaces the client's internal logger, like WithLogger.
+// It is safe to call while the client is running.
+func (c *ServiceClient) SetLogger(logger *log.Logger) {
+	c.loggerLock.Lock()
+	defer c.loggerLock.Unlock()
+	c.logger = loggerOrDiscard(logger)
+}
+
+// loggerOrDiscard returns logger, or a logger that discards everything if
+// logger is nil
+func loggerOrDiscard(logger *log.Logger) *log.Logger {
+	if logger == nil {
+		return log.New(ioutil.Discard, "", 0)
+	}
+	return logger
+}
+
+// logf logs a message with the client's internal logger, or with the
+// standard logger if none was configured
+func (c *Client) logf(format string, v ...interface{}) {
+	c.loggerLock.RLock()
+	logger := c.logger
+	c.loggerLock.RUnlock()
+	if logger != nil {
+		logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
+}
@@ -1,7 +1,8 @@
 package pubsub
 
 import (
-	"math/big"
+	"encoding/binary"
+	"fmt"
 
 	CRAND "crypto/rand"
 
@@ -50,13 +51,14 @@ func ParseMQTTQoS(QoS string) MQTTQoS {
 	}
 }
 
-// genClientID generates a random client id for mqtt
+// genClientID generates a random client id for mqtt, using a 64-bit random
+// value to make collisions between many clients unlikely
 func (c MQTTClient) genClientID() (string, error) {
-	r, err := CRAND.Int(CRAND.Reader, new(big.Int).SetInt64(100000))
-	if err != nil {
+	var r uint64
+	if err := binary.Read(CRAND.Reader, binary.BigEndian, &r); err != nil {
 		return "", err
 	}
-	return "client" + r.String(), nil
+	return fmt.Sprintf("client%016x", r), nil
 }
 
 func NewMQTTClient(
@@ -0,0 +1,72 @@
+package framework
+
+import (
+	"time"
+)
+
+// WithAutoReconnect sets whether a lost MQTT connection is reconnected
+// automatically, which is the default. Subscriptions are restored after
+// every reconnect. When disabled, the client stays disconnected after losing
+// the connection, but the OnConnectionLost callback is still called.
+func WithAutoReconnect(enabled bool) ClientOption {
+	return func(c *Client) {
+		c.autoReconnect = enabled
+	}
+}
+
+// WithMaxReconnectInterval sets the maximum time waited between the attempts
+// to reconnect a lost MQTT connection, which otherwise backs off to up to
+// 10 minutes, or to up to one minute with WithBrokerRefresh.
+func WithMaxReconnectInterval(interval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.maxReconnectInterval = interval
+	}
+}
+
+// SetOnReconnect sets a callback that is called every time the MQTT
+// connection is reestablished after it was lost, but not on the initial
+// connect. Subscriptions made with Subscribe are already restored when it is
+// called, so it is meant for reestablishing any other state, like
+// republishing a status. A nil callback removes it.
+func (c *ServiceClient) SetOnReconnect(callback func(c *ServiceClient)) {
+	var hook func()
+	if callback != nil {
+		hook = func() { callback(c) }
+	}
+	c.hooksLock.Lock()
+	defer c.hooksLock.Unlock()
+	c.onReconnectHook = hook
+}
+
+// SetOnConnectionLost sets a callback that is called with the error every time
+// the MQTT connection is lost, for logging or alerting. It is called before
+// any reconnect attempt is made. A nil callback removes it.
+func (c *ServiceClient) SetOnConnectionLost(callback func(c *ServiceClient, err error)) {
+	var hook func(error)
+	if callback != nil {
+		hook = func(err error) { callback(c, err) }
+	}
+	c.hooksLock.Lock()
+	defer c.hooksLock.Unlock()
+	c.onConnectionLostHook = hook
+}
+
+// reconnected calls the OnReconnect callback, if set
+func (c *Client) reconnected() {
+	c.hooksLock.RLock()
+	hook := c.onReconnectHook
+	c.hooksLock.RUnlock()
+	if hook != nil {
+		hook()
+	}
+}
+
+// connectionLost calls the OnConnectionLost callback, if set
+func (c *Client) connectionLost(err error) {
+	c.hooksLock.RLock()
+	hook := c.onConnectionLostHook
+	c.hooksLock.RUnlock()
+	if hook != nil {
+		hook(err)
+	}
+}
@@ -0,0 +1,69 @@
+package rest
+
+import (
+	"encoding/json"
+)
+
+// AuditReport is the result of checking all devices linked to a service
+// against the service's config parameters
+type AuditReport struct {
+	Service ServiceNode   `json:"service"`
+	Devices int           `json:"devices"`    // Number of linked devices checked
+	Invalid []DeviceAudit `json:"violations"` // Only devices with problems
+}
+
+// DeviceAudit lists the config problems of a single device
+type DeviceAudit struct {
+	DeviceID   string       `json:"id"`
+	DeviceName string       `json:"name"`
+	Errors     ConfigErrors `json:"-"`
+}
+
+// MarshalJSON renders the config problems as messages
+func (a DeviceAudit) MarshalJSON() ([]byte, error) {
+	msgs := make([]string, len(a.Errors))
+	for i, err := range a.Errors {
+		msgs[i] = err.Error()
+	}
+	return json.Marshal(struct {
+		DeviceID   string   `json:"id"`
+		DeviceName string   `json:"name"`
+		Errors     []string `json:"errors"`
+	}{a.DeviceID, a.DeviceName, msgs})
+}
+
+func (r AuditReport) String() string {
+	buf, _ := json.MarshalIndent(&r, "", jsonPrettyIndent)
+	return string(buf)
+}
+
+// AuditService fetches the service serviceid and all of its linked devices,
+// and reports every device whose config violates the service's config
+// parameters, as checked by ServiceNode.ValidateDeviceConfig.
+// Devices are reported in the order that the framework server lists them.
+func (host Host) AuditService(serviceid string) (AuditReport, error) {
+	var report AuditReport
+	service, err := host.RequestServiceInfo(serviceid)
+	if err != nil {
+		return report, err
+	}
+	devices, err := host.RequestServiceDeviceList(serviceid)
+	if err != nil {
+		return report, err
+	}
+
+	report.Service = service
+	report.Devices = len(devices)
+	for _, device := range devices {
+		err := service.ValidateDeviceConfig(device.GetConfigMap())
+		if err == nil {
+			continue
+		}
+		report.Invalid = append(report.Invalid, DeviceAudit{
+			DeviceID:   device.Id,
+			DeviceName: device.Name,
+			Errors:     err.(ConfigErrors),
+		})
+	}
+	return report, nil
+}
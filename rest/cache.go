@@ -0,0 +1,92 @@
+package rest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// defaultServiceInfoCacheSize is the number of services kept by
+// WithServiceInfoCache when the given size is not positive
+const defaultServiceInfoCacheSize = 100
+
+// serviceInfoCache is a bounded TTL cache of service nodes, keyed by the
+// service id. Entries are only used for the same user that fetched them.
+type serviceInfoCache struct {
+	lock  sync.Mutex
+	ttl   time.Duration
+	nodes *lru.Cache
+}
+
+type serviceInfoCacheEntry struct {
+	user    string
+	node    ServiceNode
+	expires time.Time
+}
+
+func newServiceInfoCache(ttl time.Duration, size int) *serviceInfoCache {
+	if size <= 0 {
+		// an lru.Cache of size 0 is unbounded
+		size = defaultServiceInfoCacheSize
+	}
+	return &serviceInfoCache{ttl: ttl, nodes: lru.New(size)}
+}
+
+func (c *serviceInfoCache) get(user, serviceid string) (ServiceNode, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	value, ok := c.nodes.Get(serviceid)
+	if !ok {
+		return ServiceNode{}, false
+	}
+	entry := value.(serviceInfoCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.nodes.Remove(serviceid)
+		return ServiceNode{}, false
+	}
+	if entry.user != user {
+		return ServiceNode{}, false
+	}
+	// hand out copies, so that callers can not change the cached node
+	return entry.node.Clone(), true
+}
+
+func (c *serviceInfoCache) add(user, serviceid string, node ServiceNode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nodes.Add(serviceid, serviceInfoCacheEntry{
+		user:    user,
+		node:    node.Clone(),
+		expires: time.Now().Add(c.ttl),
+	})
+}
+
+func (c *serviceInfoCache) remove(serviceid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nodes.Remove(serviceid)
+}
+
+// WithServiceInfoCache caches the results of RequestServiceInfo for up to ttl,
+// keeping at most size services. A size of 0 or less keeps the default of 100
+// services. Cache hits skip the network entirely, which
+// cuts the load of tools that repeatedly read the same services.
+// The cache is shared by all copies of the Host and is safe for concurrent
+// use. Updating or deleting a service through the Host invalidates its entry,
+// other changes are only seen once the entry expires or is invalidated with
+// InvalidateServiceInfo.
+func WithServiceInfoCache(ttl time.Duration, size int) HostOption {
+	return func(host *Host) {
+		host.serviceCache = newServiceInfoCache(ttl, size)
+	}
+}
+
+// InvalidateServiceInfo drops the cached service info of serviceid, if
+// WithServiceInfoCache is used, so that the next RequestServiceInfo fetches
+// it from the framework server.
+func (host Host) InvalidateServiceInfo(serviceid string) {
+	if host.serviceCache != nil {
+		host.serviceCache.remove(serviceid)
+	}
+}
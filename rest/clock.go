@@ -0,0 +1,77 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrNoServerTime is returned when the framework server's response carries no
+// valid Date header
+var ErrNoServerTime = errors.New("Server did not report its time")
+
+// ErrClockSkew is returned (wrapped) by CheckClockSkew when the local clock
+// is too far off from the framework server's clock
+var ErrClockSkew = errors.New("Clock skew too large")
+
+// serverTime makes a lightweight authenticated HTTP GET to the framework
+// server and returns the time from the response's Date header, along with the
+// local time halfway through the request
+func (host Host) serverTime() (server, local time.Time, err error) {
+	uri := host.endpoint(rootAPISubPath, userSubPath)
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return server, local, err
+	}
+	req.SetBasicAuth(host.user, host.pass)
+
+	start := time.Now()
+	resp, err := host.do(req)
+	if err != nil {
+		return server, local, err
+	}
+	defer resp.Body.Close()
+	local = start.Add(time.Since(start) / 2)
+
+	// the Date header is set regardless of the status
+	server, err = http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return server, local, ErrNoServerTime
+	}
+	return server, local, nil
+}
+
+// ServerTime returns the framework server's current time, as reported by the
+// Date header of a lightweight request. The Date header only has a resolution
+// of one second.
+func (host Host) ServerTime() (time.Time, error) {
+	server, _, err := host.serverTime()
+	return server, err
+}
+
+// ClockSkew returns how far the framework server's clock is ahead of the
+// local clock, which is negative if the server is behind. The server time is
+// compared against the local time halfway through the request, but since the
+// Date header only has a resolution of one second, so does the skew.
+func (host Host) ClockSkew() (time.Duration, error) {
+	server, local, err := host.serverTime()
+	if err != nil {
+		return 0, err
+	}
+	return server.Sub(local.Truncate(time.Second)), nil
+}
+
+// CheckClockSkew is like ClockSkew, but also returns ErrClockSkew if the skew
+// is larger than max in either direction. The skew is returned in any case,
+// so that time-based requests, like RequestServiceEvents, can compensate for it.
+func (host Host) CheckClockSkew(max time.Duration) (time.Duration, error) {
+	skew, err := host.ClockSkew()
+	if err != nil {
+		return 0, err
+	}
+	if skew > max || skew < -max {
+		return skew, fmt.Errorf("%w: server is %v ahead", ErrClockSkew, skew)
+	}
+	return skew, nil
+}
@@ -0,0 +1,34 @@
+package rest_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestHost_ClockSkew(t *testing.T) {
+	offset := time.Hour
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	skew, err := host.CheckClockSkew(time.Minute)
+	if !errors.Is(err, rest.ErrClockSkew) {
+		t.Error("Expected ErrClockSkew, but got:", err)
+	}
+	if skew < offset-2*time.Second || skew > offset+2*time.Second {
+		t.Error("Unexpected skew:", skew)
+	}
+
+	offset = 0
+	if _, err := host.CheckClockSkew(time.Minute); err != nil {
+		t.Error("Unexpected skew error:", err)
+	}
+}
@@ -6,10 +6,16 @@ package rest
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
+	"sort"
+	"sync"
 )
 
+// ErrServiceNotLinked is returned when a device is not linked to the
+// requested service
+var ErrServiceNotLinked = errors.New("Service is not linked to the device")
+
 // DeviceListServiceItem represents the service and service configuration pair
 // found in in a Device Node's service list
 type DeviceListServiceItem struct {
@@ -29,33 +35,192 @@ type DeviceNode struct {
 // the Device Node information for the device with ID deviceid.
 func (host Host) RequestDeviceInfo(deviceid string) (DeviceNode, error) {
 	var deviceNode DeviceNode
-	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceid
-	fmt.Println("DevURI:", uri)
+	uri := host.endpoint(rootAPISubPath, deviceSubPath, deviceid)
 	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return deviceNode, err
+	}
 	req.SetBasicAuth(host.user, host.pass)
 
-	// resp, err := http.Get(uri)
-	resp, err := host.client.Do(req)
+	resp, err := host.doOp(OpRequestDeviceInfo, req)
 	if err != nil {
-		// should report auth problems here in future
 		return deviceNode, err
 	}
 	defer resp.Body.Close()
-	err = json.NewDecoder(resp.Body).Decode(&deviceNode)
+	if !host.statusOK(resp) {
+		return deviceNode, statusError(resp)
+	}
+	err = host.decodeResponse(resp, &deviceNode)
 	return deviceNode, err
 }
 
+// deviceServiceConfigRequest describes the JSON blob sent to set a device's
+// service config
+type deviceServiceConfigRequest struct {
+	Config []KeyValuePair `json:"config"`
+}
+
+// ConfigWriteOption changes how SetDeviceServiceConfig and
+// PatchDeviceServiceConfig write a device's service config
+type ConfigWriteOption func(*configWriteOptions)
+
+type configWriteOptions struct {
+	validate *ServiceNode
+	dryRun   bool
+}
+
+// WithConfigValidation validates the config against the given service's
+// config parameters, using ServiceNode.ValidateDeviceConfig, before it is
+// written. The config is not written if it is invalid and the ConfigErrors
+// are returned.
+func WithConfigValidation(service ServiceNode) ConfigWriteOption {
+	return func(o *configWriteOptions) {
+		o.validate = &service
+	}
+}
+
+// WithDryRun skips writing the config to the framework server, so that only
+// the validation set by WithConfigValidation is run
+func WithDryRun() ConfigWriteOption {
+	return func(o *configWriteOptions) {
+		o.dryRun = true
+	}
+}
+
+// SetDeviceServiceConfig makes an HTTP PUT request to the framework server
+// in order to replace the whole service config of the device deviceid for
+// the linked service serviceid. Keys missing from config are dropped, use
+// PatchDeviceServiceConfig to only change some keys.
+func (host Host) SetDeviceServiceConfig(serviceid, deviceid string, config map[string]string, opts ...ConfigWriteOption) error {
+	var o configWriteOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.validate != nil {
+		if err := o.validate.ValidateDeviceConfig(config); err != nil {
+			return err
+		}
+	}
+	if o.dryRun {
+		return nil
+	}
+
+	uri := host.endpoint(rootAPISubPath, deviceSubPath, deviceid, servicesSubPath, serviceid)
+
+	// sort the keys, so that the request is deterministic
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	configReq := deviceServiceConfigRequest{Config: make([]KeyValuePair, len(keys))}
+	for i, key := range keys {
+		configReq.Config[i] = KeyValuePair{Key: key, Value: config[key]}
+	}
+
+	body, err := json.Marshal(&configReq)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.SetBasicAuth(host.user, host.pass)
+
+	resp, err := host.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !host.statusOK(resp) {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// PatchDeviceServiceConfig changes only the given keys of the service config
+// of the device deviceid for the linked service serviceid, leaving all other
+// keys untouched. The current config is read from the device info and the
+// merged config is written with SetDeviceServiceConfig, so a concurrent change
+// to other keys between the two requests may be overwritten.
+// The opts are applied to the merged config, as in SetDeviceServiceConfig.
+// ErrServiceNotLinked is returned if the device is not linked to the service.
+func (host Host) PatchDeviceServiceConfig(serviceid, deviceid string, changes map[string]string, opts ...ConfigWriteOption) error {
+	device, err := host.RequestDeviceInfo(deviceid)
+	if err != nil {
+		return err
+	}
+	for _, link := range device.Services {
+		if link.ServiceID != serviceid {
+			continue
+		}
+		config := make(map[string]string, len(link.ServiceConfig)+len(changes))
+		for _, kv := range link.ServiceConfig {
+			config[kv.Key] = kv.Value
+		}
+		for key, value := range changes {
+			config[key] = value
+		}
+		return host.SetDeviceServiceConfig(serviceid, deviceid, config, opts...)
+	}
+	return ErrServiceNotLinked
+}
+
+// SetDeviceServiceConfigBulk applies the same config changes to the service
+// config of every device in deviceIDs, like PatchDeviceServiceConfig, with a
+// bounded number of requests in flight. This is intended for fleet wide
+// config rollouts and migrations.
+// All devices are attempted, even if some fail. The returned map holds the
+// result of every device, which is nil for a device that was patched. The
+// failures are also returned together as DeviceErrors.
+func (host Host) SetDeviceServiceConfigBulk(serviceid string, deviceIDs []string, changes map[string]string, opts ...ConfigWriteOption) (map[string]error, error) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]error, len(deviceIDs))
+	errs := make(DeviceErrors)
+	sem := make(chan struct{}, deviceOpsConcurrency)
+	for _, deviceid := range deviceIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(deviceid string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := host.PatchDeviceServiceConfig(serviceid, deviceid, changes, opts...)
+			lock.Lock()
+			results[deviceid] = err
+			if err != nil {
+				errs[deviceid] = err
+			}
+			lock.Unlock()
+		}(deviceid)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
 // ExecuteCommand makes an HTTP POST to the framework server to execute the
 // specified commmandID on device deviceID.
 func (host Host) ExecuteCommand(deviceID, commandID string) error {
-	uri := host.uri + rootAPISubPath + deviceSubPath + "/" + deviceID + "/command/" + commandID
+	uri := host.endpoint(rootAPISubPath, deviceSubPath, deviceID, "command", commandID)
 	req, err := http.NewRequest("POST", uri, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return err
+	}
 	req.SetBasicAuth(host.user, host.pass)
 
-	// resp, err := http.Get(uri)
-	resp, err := host.client.Do(req)
+	resp, err := host.do(req)
 	if err != nil {
-		resp.Body.Close()
+		return err
+	}
+	defer resp.Body.Close()
+	if !host.statusOK(resp) {
+		return statusError(resp)
 	}
-	return err
+	return nil
 }
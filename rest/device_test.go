@@ -0,0 +1,154 @@
+package rest_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestHost_PatchDeviceServiceConfig(t *testing.T) {
+	var written []rest.KeyValuePair
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/apiv1/device/d1":
+			w.Write([]byte(`{"id":"d1","linked_services":[
+				{"service_id":"other","config":[{"key":"a","value":"other"}]},
+				{"service_id":"s1","config":[{"key":"a","value":"1"},{"key":"b","value":"2"}]}
+			]}`))
+		case r.Method == "PUT" && r.URL.Path == "/apiv1/device/d1/service/s1":
+			var body struct {
+				Config []rest.KeyValuePair `json:"config"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			written = body.Config
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	if err := host.PatchDeviceServiceConfig("s1", "d1", map[string]string{"b": "3", "c": "4"}); err != nil {
+		t.Fatal("Error patching device service config:", err)
+	}
+	expected := []rest.KeyValuePair{{Key: "a", Value: "1"}, {Key: "b", Value: "3"}, {Key: "c", Value: "4"}}
+	if len(written) != len(expected) {
+		t.Fatal("Unexpected written config:", written)
+	}
+	for i := range expected {
+		if written[i] != expected[i] {
+			t.Error("Unexpected written config:", written)
+			break
+		}
+	}
+
+	if err := host.PatchDeviceServiceConfig("s2", "d1", nil); err != rest.ErrServiceNotLinked {
+		t.Error("Expected ErrServiceNotLinked, but got:", err)
+	}
+	// an unknown device is not mistaken for an unlinked service
+	err := host.PatchDeviceServiceConfig("s1", "d2", nil)
+	var httpErr *rest.HTTPError
+	if !errors.As(err, &httpErr) || !errors.Is(err, rest.ErrNotFound) {
+		t.Error("Expected a not found HTTPError, but got:", err)
+	}
+}
+
+func TestHost_ExecuteCommand(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && r.URL.Path == "/apiv1/device/d1/command/c1" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	host := rest.NewHost(server.URL)
+	if err := host.ExecuteCommand("d1", "c1"); err != nil {
+		t.Error("Error executing command:", err)
+	}
+	if err := host.ExecuteCommand("d1", "c2"); !errors.Is(err, rest.ErrNotFound) {
+		t.Error("Expected ErrNotFound, but got:", err)
+	}
+
+	// a network error must be returned instead of panicking
+	server.Close()
+	if err := host.ExecuteCommand("d1", "c1"); err == nil {
+		t.Error("Expected an error from a closed server")
+	}
+}
+
+func TestHost_SetDeviceServiceConfigBulk(t *testing.T) {
+	var lock sync.Mutex
+	written := make(map[string][]rest.KeyValuePair)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apiv1/device/d1", "/apiv1/device/d2":
+			w.Write([]byte(`{"linked_services":[{"service_id":"s1","config":[{"key":"a","value":"1"}]}]}`))
+		case "/apiv1/device/d1/service/s1", "/apiv1/device/d2/service/s1":
+			var body struct {
+				Config []rest.KeyValuePair `json:"config"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			lock.Lock()
+			written[r.URL.Path] = body.Config
+			lock.Unlock()
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	results, err := host.SetDeviceServiceConfigBulk("s1", []string{"d1", "d2", "d3"}, map[string]string{"b": "2"})
+	errs, ok := err.(rest.DeviceErrors)
+	if !ok || len(errs) != 1 || errs["d3"] == nil {
+		t.Fatal("Expected only d3 to fail, but got:", err)
+	}
+	if len(results) != 3 || results["d1"] != nil || results["d2"] != nil || results["d3"] == nil {
+		t.Error("Unexpected results:", results)
+	}
+	for _, path := range []string{"/apiv1/device/d1/service/s1", "/apiv1/device/d2/service/s1"} {
+		if config := written[path]; len(config) != 2 || config[1] != (rest.KeyValuePair{Key: "b", Value: "2"}) {
+			t.Errorf("Unexpected config written to %s: %v", path, config)
+		}
+	}
+}
+
+func TestHost_SetDeviceServiceConfigValidation(t *testing.T) {
+	var puts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		puts++
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	var service rest.ServiceNode
+	service.ConfigParameters = []rest.ServiceConfigParameter{
+		{Name: "rate", Required: true, Type: rest.TypeInt},
+	}
+	host := rest.NewHost(server.URL)
+
+	err := host.SetDeviceServiceConfig("s1", "d1", map[string]string{"rate": "fast"}, rest.WithConfigValidation(service))
+	if errs, ok := err.(rest.ConfigErrors); !ok || len(errs) != 1 || !errors.Is(errs[0], rest.ErrInvalidConfigValue) {
+		t.Error("Expected ErrInvalidConfigValue, but got:", err)
+	}
+	err = host.SetDeviceServiceConfig("s1", "d1", map[string]string{"rate": "10"}, rest.WithConfigValidation(service), rest.WithDryRun())
+	if err != nil {
+		t.Error("Unexpected dry run error:", err)
+	}
+	if puts != 0 {
+		t.Fatal("Expected no requests, but got", puts)
+	}
+
+	err = host.SetDeviceServiceConfig("s1", "d1", map[string]string{"rate": "10"}, rest.WithConfigValidation(service))
+	if err != nil || puts != 1 {
+		t.Error("Expected the valid config to be written, but got:", err)
+	}
+}
@@ -0,0 +1,70 @@
+package rest
+
+// EffectiveDeviceConfig is a device's config merged over the default values
+// of the service's config parameters, along with its validation status
+type EffectiveDeviceConfig struct {
+	DeviceID   string
+	DeviceName string
+	// Config is the device's config with the defaults filled in
+	Config map[string]string
+	// Defaulted lists the keys of Config that were filled in from defaults
+	Defaulted []string
+	// Errors are the problems of the effective config, as reported by
+	// ServiceNode.ValidateDeviceConfig, or nil if it is valid
+	Errors ConfigErrors
+}
+
+// Valid tells if the effective config has no problems
+func (c EffectiveDeviceConfig) Valid() bool {
+	return len(c.Errors) == 0
+}
+
+// EffectiveConfig returns a copy of config with the default values of the
+// service's config parameters filled in for keys that are absent or empty,
+// along with the keys that were filled in. Parameters without a default are
+// left as they are.
+func (n ServiceNode) EffectiveConfig(config map[string]string) (map[string]string, []string) {
+	effective := make(map[string]string, len(config))
+	for key, value := range config {
+		effective[key] = value
+	}
+	var defaulted []string
+	for _, param := range n.ConfigParameters {
+		if param.Default == "" || effective[param.Name] != "" {
+			continue
+		}
+		effective[param.Name] = param.Default
+		defaulted = append(defaulted, param.Name)
+	}
+	return effective, defaulted
+}
+
+// RequestServiceDeviceConfigsEffective fetches the service serviceid and all
+// of its linked devices, and returns every device's effective config, as
+// merged by ServiceNode.EffectiveConfig, along with its validation status.
+// Devices are returned in the order that the framework server lists them.
+func (host Host) RequestServiceDeviceConfigsEffective(serviceid string) ([]EffectiveDeviceConfig, error) {
+	service, err := host.RequestServiceInfo(serviceid)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := host.RequestServiceDeviceList(serviceid)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]EffectiveDeviceConfig, len(devices))
+	for i, device := range devices {
+		config, defaulted := service.EffectiveConfig(device.GetConfigMap())
+		configs[i] = EffectiveDeviceConfig{
+			DeviceID:   device.Id,
+			DeviceName: device.Name,
+			Config:     config,
+			Defaulted:  defaulted,
+		}
+		if err := service.ValidateDeviceConfig(config); err != nil {
+			configs[i].Errors = err.(ConfigErrors)
+		}
+	}
+	return configs, nil
+}
@@ -0,0 +1,51 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ErrServerError is returned (wrapped) when the framework server responds with
+// an error object, as detected by WithErrorField
+var ErrServerError = errors.New("Server responded with an error")
+
+// WithErrorField makes the host check the decoded responses for a top-level
+// error field, like {"error":"..."}, for servers that report failures with a
+// success status. A response with a non-empty error field is returned as
+// ErrServerError, including the field's message, instead of being decoded.
+// The field is usually named "error". By default, no field is checked.
+func WithErrorField(field string) HostOption {
+	return func(host *Host) {
+		host.errorField = field
+	}
+}
+
+// checkErrorField reads the JSON doc from r and returns ErrServerError if it
+// is an object with a non-empty field. The returned reader replays the whole
+// document.
+func checkErrorField(r io.Reader, field string) (io.Reader, error) {
+	doc, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(doc, &obj) != nil {
+		// not an object, let the regular decoding handle it
+		return bytes.NewReader(doc), nil
+	}
+	value := bytes.TrimSpace(obj[field])
+	switch string(value) {
+	case "", "null", "false", `""`, "{}":
+		return bytes.NewReader(doc), nil
+	}
+	var msg string
+	if json.Unmarshal(value, &msg) != nil {
+		// not a string, like an object with a code and message
+		msg = string(value)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrServerError, msg)
+}
@@ -29,23 +29,28 @@ func (host Host) RequestLocationInfo(locid string) (LocationNode, error) {
 	var locNode LocationNode
 	var uri string
 	if locid == "" {
-		uri = host.uri + rootAPISubPath + locationSubPath
+		uri = host.endpoint(rootAPISubPath, locationSubPath)
 	} else {
-		uri = host.uri + rootAPISubPath + locationSubPath + "/" + locid
+		uri = host.endpoint(rootAPISubPath, locationSubPath, locid)
 	}
 	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return locNode, err
+	}
 	req.SetBasicAuth(host.user, host.pass)
 
-	resp, err := host.client.Do(req)
+	resp, err := host.do(req)
 	if err != nil {
-		// should report auth problems here in future
 		return locNode, err
 	}
 	defer resp.Body.Close()
+	if !host.statusOK(resp) {
+		return locNode, statusError(resp)
+	}
 	if locid == "" {
 		// TODO: Figure out why the root node is in an array
 		var roots []LocationNode
-		err = json.NewDecoder(resp.Body).Decode(&roots)
+		err = host.decodeResponse(resp, &roots)
 		if err != nil {
 			return locNode, err
 		}
@@ -54,7 +59,7 @@ func (host Host) RequestLocationInfo(locid string) (LocationNode, error) {
 		}
 		locNode = roots[0]
 	} else {
-		err = json.NewDecoder(resp.Body).Decode(&locNode)
+		err = host.decodeResponse(resp, &locNode)
 	}
 
 	return locNode, err
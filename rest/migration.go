@@ -0,0 +1,74 @@
+package rest
+
+import (
+	"sort"
+)
+
+// ConfigMigration is the plan for migrating one device's config from a
+// service's old config parameters to its new ones
+type ConfigMigration struct {
+	DeviceID string `json:"id"`
+	// Fill lists the required parameters that the device has no value for,
+	// which must be filled in before the device's config is valid again
+	Fill []ServiceConfigParameter `json:"fill,omitempty"`
+	// Suggested maps the parameters in Fill to their example values, as a
+	// starting point for the new values
+	Suggested map[string]string `json:"suggested,omitempty"`
+	// Invalid lists the values that no longer match their parameter's type
+	Invalid ConfigErrors `json:"-"`
+	// Obsolete lists the device's config keys whose parameters were removed
+	Obsolete []string `json:"obsolete,omitempty"`
+}
+
+// NeedsMigration tells if anything must be done to the device's config
+func (m ConfigMigration) NeedsMigration() bool {
+	return len(m.Fill) > 0 || len(m.Invalid) > 0 || len(m.Obsolete) > 0
+}
+
+// PlanConfigMigration computes what is needed to migrate the device config
+// from the config parameters oldParams to newParams.
+// Obsolete keys are only reported if they were declared by oldParams, so that
+// keys that were never part of the service's schema are left alone.
+func PlanConfigMigration(oldParams, newParams []ServiceConfigParameter, config map[string]string) ConfigMigration {
+	var m ConfigMigration
+	declared := make(map[string]bool, len(newParams))
+	for _, param := range newParams {
+		declared[param.Name] = true
+		value := config[param.Name]
+		if value == "" {
+			if param.Required {
+				m.Fill = append(m.Fill, param)
+				if m.Suggested == nil {
+					m.Suggested = make(map[string]string)
+				}
+				m.Suggested[param.Name] = param.Example
+			}
+			continue
+		}
+		if err := param.ValidateValue(value); err != nil {
+			m.Invalid = append(m.Invalid, err)
+		}
+	}
+	for _, param := range oldParams {
+		if _, ok := config[param.Name]; ok && !declared[param.Name] {
+			m.Obsolete = append(m.Obsolete, param.Name)
+		}
+	}
+	sort.Strings(m.Obsolete)
+	return m
+}
+
+// PlanServiceMigration computes the migration plan of every device linked to
+// a service, whose config parameters change from oldParams to newParams.
+// Only devices that need a migration are included, in the order given.
+func PlanServiceMigration(oldParams, newParams []ServiceConfigParameter, devices []ServiceDeviceListItem) []ConfigMigration {
+	var plan []ConfigMigration
+	for _, device := range devices {
+		m := PlanConfigMigration(oldParams, newParams, device.GetConfigMap())
+		if m.NeedsMigration() {
+			m.DeviceID = device.Id
+			plan = append(plan, m)
+		}
+	}
+	return plan
+}
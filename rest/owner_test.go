@@ -0,0 +1,46 @@
+package rest_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestOwner_UnmarshalJSON(t *testing.T) {
+	var node rest.ServiceNode
+	if err := json.Unmarshal([]byte(`{"owner":"5930aaf27d6ec25f901d96da"}`), &node); err != nil {
+		t.Fatal("Error decoding string owner:", err)
+	}
+	if node.Owner.Id != "5930aaf27d6ec25f901d96da" {
+		t.Error("Unexpected string owner:", node.Owner)
+	}
+
+	node = rest.ServiceNode{}
+	if err := json.Unmarshal([]byte(`{"owner":{"id":"u1","name":"User","email":"u@example.com"}}`), &node); err != nil {
+		t.Fatal("Error decoding object owner:", err)
+	}
+	if node.Owner.Id != "u1" || node.Owner.Email != "u@example.com" {
+		t.Error("Unexpected object owner:", node.Owner)
+	}
+}
+
+func TestHost_OwnerEncoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"s1","owner":"u1"}`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL, rest.WithOwnerEncoding(rest.OwnerEncodingString))
+	if sNode, err := host.RequestServiceInfo("s1"); err != nil || sNode.Owner.Id != "u1" {
+		t.Error("Expected the string owner to be accepted, but got:", sNode.Owner, err)
+	}
+
+	host = rest.NewHost(server.URL, rest.WithOwnerEncoding(rest.OwnerEncodingObject))
+	if _, err := host.RequestServiceInfo("s1"); !errors.Is(err, rest.ErrOwnerEncoding) {
+		t.Error("Expected ErrOwnerEncoding, but got:", err)
+	}
+}
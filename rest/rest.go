@@ -7,7 +7,18 @@
 package rest
 
 import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 )
 
 const (
@@ -15,16 +26,61 @@ const (
 	deviceSubPath         = "/device"
 	servicesSubPath       = "/service"
 	serviceDevicesSubPath = "/things"
+	serviceEventsSubPath  = "/events"
 	locationSubPath       = "/location"
 	userSubPath           = "/user"
-)
-
-const (
-	httpStatusCodeOK = 200
+	pubsubSubPath         = "/pubsub"
 )
 
 const jsonPrettyIndent = "  "
 
+// deviceOpsConcurrency bounds the number of concurrent requests made by
+// methods that fan out across many devices
+const deviceOpsConcurrency = 8
+
+const maxRedirects = 10
+
+// requestIDHeader carries the unique id of every request, which allows
+// correlating requests with the framework server's logs
+const requestIDHeader = "X-Request-ID"
+
+// ErrRedirectNotFollowed is returned (wrapped) when the framework server
+// redirects a request that can not be safely followed, like a POST or DELETE.
+var ErrRedirectNotFollowed = errors.New("Redirect not followed")
+
+// ErrUnauthorized is returned when the framework server rejects the
+// credentials provided to Login
+var ErrUnauthorized = errors.New("Unauthorized")
+
+// ErrForbidden is returned when the authenticated user is not permitted to
+// access the requested resource
+var ErrForbidden = errors.New("Forbidden")
+
+// ErrConflict is returned when the framework server rejects a versioned
+// update, because the resource was changed since the given version was read
+var ErrConflict = errors.New("Conflict")
+
+// ErrNotFound matches an HTTPError for a resource that does not exist, like
+// a service id that is unknown to the framework server
+var ErrNotFound = errors.New("Not found")
+
+// DeviceErrors aggregates the errors of an operation that was applied to
+// many devices. It maps device ids to the error encountered for that device.
+type DeviceErrors map[string]error
+
+func (e DeviceErrors) Error() string {
+	ids := make([]string, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		msgs[i] = fmt.Sprintf("%s: %v", id, e[id])
+	}
+	return fmt.Sprintf("%d device(s) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
 // Host represents the RESTful HTTP server that hosts the framework
 type Host struct {
 	uri string
@@ -32,12 +88,257 @@ type Host struct {
 	user   string
 	pass   string
 	client http.Client
+	// followUnsafeRedirects allows following redirects of non GET requests
+	followUnsafeRedirects bool
+	// serviceCache caches RequestServiceInfo results, if enabled
+	serviceCache *serviceInfoCache
+	// requestID generates the X-Request-ID of every request
+	requestID func() string
+	// refetchCreated makes ServiceCreate return the re-fetched service
+	refetchCreated bool
+	// paramSchema renames the config parameter fields, if set
+	paramSchema *ConfigParameterSchema
+	// acceptedStatus is the set of successful response status codes
+	acceptedStatus map[int]bool
+	// ownerEncoding restricts the accepted owner encoding, if not auto
+	ownerEncoding OwnerEncoding
+	// timeout limits every request, unless overridden in opTimeouts
+	timeout    time.Duration
+	opTimeouts map[Operation]time.Duration
+	// errorField is the top-level response field that reports an error
+	errorField string
+	// retryAttempts and retryDelay configure the retries of idempotent
+	// requests, if enabled
+	retryAttempts int
+	retryDelay    time.Duration
+	// logger receives debug output, if set
+	logger *log.Logger
+}
+
+// HostOption configures optional Host behavior in NewHost
+type HostOption func(*Host)
+
+// WithUnsafeRedirects allows redirects of requests that modify state, like
+// ServiceCreate's POST or ServiceDelete's DELETE, to be followed.
+// These redirects are only followed when the server asks for the method to be
+// preserved (307/308). A 301/302/303 would turn them into a GET, so they
+// always fail with ErrRedirectNotFollowed.
+func WithUnsafeRedirects() HostOption {
+	return func(host *Host) {
+		host.followUnsafeRedirects = true
+	}
+}
+
+// WithTLSConfig makes the host use a transport with the given TLS config,
+// which allows using custom root CAs or client certificates (mTLS) to talk to
+// the framework server. The other transport settings match
+// http.DefaultTransport.
+func WithTLSConfig(config *tls.Config) HostOption {
+	return func(host *Host) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		host.client.Transport = transport
+	}
+}
+
+// WithAcceptedStatus sets the response status codes that are considered a
+// success. By default, any 2xx status is a success, so this is only needed
+// for a stricter check, like only accepting 200, or to accept other codes.
+// Responses with other status codes are returned as errors.
+func WithAcceptedStatus(codes ...int) HostOption {
+	return func(host *Host) {
+		host.acceptedStatus = make(map[int]bool, len(codes))
+		for _, code := range codes {
+			host.acceptedStatus[code] = true
+		}
+	}
+}
+
+// WithCreateRefetch makes ServiceCreate re-fetch the created service with
+// RequestServiceInfo, so that it returns the complete service node,
+// including the fields filled in by the framework server, like the assigned
+// pubsub topics. This costs an additional request per created service.
+func WithCreateRefetch() HostOption {
+	return func(host *Host) {
+		host.refetchCreated = true
+	}
+}
+
+// WithRequestIDGenerator sets the function that generates the unique id sent
+// as the X-Request-ID header of every request. By default, a random UUID is
+// used. The id is also included in the errors returned for failed requests.
+// A nil generator disables the header.
+func WithRequestIDGenerator(generator func() string) HostOption {
+	return func(host *Host) {
+		host.requestID = generator
+	}
+}
+
+// NewRequestID returns a random (version 4) UUID, which is the default
+// request id used by NewHost
+func NewRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
 }
 
 // NewHost returns an object referencing the framework server
-func NewHost(uri string) Host {
+//
+// By default, only GET requests follow redirects. The basic auth credentials
+// are carried along to redirects on the same host, but never to another host.
+func NewHost(uri string, opts ...HostOption) Host {
 	// no need to decompose uri using net/url package
-	return Host{uri: uri, client: http.Client{}}
+	host := Host{uri: uri, client: http.Client{}, requestID: NewRequestID}
+	for _, opt := range opts {
+		opt(&host)
+	}
+	host.client.CheckRedirect = redirectPolicy(host.followUnsafeRedirects)
+	return host
+}
+
+// WithLogger sends the Host's debug output, like the requests it makes, to
+// logger. By default, the Host logs nothing. Request bodies are never logged,
+// since they may carry credentials or other secrets.
+func WithLogger(logger *log.Logger) HostOption {
+	return func(host *Host) {
+		host.logger = logger
+	}
+}
+
+// debugf logs to the logger set by WithLogger, if any
+func (host Host) debugf(format string, v ...interface{}) {
+	if host.logger != nil {
+		host.logger.Printf(format, v...)
+	}
+}
+
+// NewHostWithLogin is like NewHost followed by Login, which allows setting up
+// a Host with its credentials and options, like WithTimeout, in one call
+func NewHostWithLogin(uri, user, pass string, opts ...HostOption) Host {
+	host := NewHost(uri, opts...)
+	host.Login(user, pass)
+	return host
+}
+
+// do sends req using the host's HTTP client, after tagging it with a request
+// id. Errors are annotated with the request id.
+// The timeout set by WithTimeout is applied.
+func (host Host) do(req *http.Request) (*http.Response, error) {
+	return host.doOp("", req)
+}
+
+// send sends req like do, without applying a timeout
+func (host Host) send(req *http.Request) (*http.Response, error) {
+	var id string
+	if host.requestID != nil {
+		id = host.requestID()
+	}
+	if id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	host.debugf("%s %s (request id %s)", req.Method, req.URL, id)
+	resp, err := host.client.Do(req)
+	if err != nil && id != "" {
+		return resp, fmt.Errorf("%w (request id %s)", err, id)
+	}
+	return resp, err
+}
+
+// statusOK tells if the response status is a success, which is any 2xx
+// status, unless configured otherwise by WithAcceptedStatus
+func (host Host) statusOK(resp *http.Response) bool {
+	if host.acceptedStatus != nil {
+		return host.acceptedStatus[resp.StatusCode]
+	}
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// maxErrorBodySnippet is the number of response body bytes kept in an
+// HTTPError
+const maxErrorBodySnippet = 512
+
+// HTTPError is returned by the REST methods when the framework server
+// responds with an unexpected status. Use errors.As to inspect the status,
+// or errors.Is with ErrUnauthorized, ErrForbidden, ErrNotFound, or
+// ErrConflict to check for the common statuses.
+type HTTPError struct {
+	// StatusCode is the response's status code, like 404
+	StatusCode int
+	// Status is the response's status, like "404 Not Found"
+	Status string
+	// Body is the beginning of the response body, for debugging
+	Body string
+	// RequestID is the id that the request was tagged with, if any
+	RequestID string
+}
+
+func (e *HTTPError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("%v (request id %s)", e.Status, e.RequestID)
+	}
+	return e.Status
+}
+
+// Is reports whether the status matches one of the status errors, like
+// ErrNotFound for a 404
+func (e *HTTPError) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return target == ErrConflict
+	}
+	return false
+}
+
+// statusError returns the HTTPError for a response with an unexpected
+// status, which includes the request id, if the request had one
+func statusError(resp *http.Response) error {
+	err := &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	if resp.Request != nil {
+		err.RequestID = resp.Request.Header.Get(requestIDHeader)
+	}
+	if resp.Body != nil {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySnippet))
+		err.Body = string(body)
+	}
+	return err
+}
+
+// redirectPolicy returns the http.Client CheckRedirect function that decides
+// which redirects are followed
+func redirectPolicy(followUnsafe bool) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("Stopped after %d redirects", maxRedirects)
+		}
+		orig := via[0]
+		if orig.Method != http.MethodGet && orig.Method != http.MethodHead {
+			if !followUnsafe || req.Method != orig.Method {
+				return fmt.Errorf("%w: %s %s was redirected to %s",
+					ErrRedirectNotFollowed, orig.Method, orig.URL, req.URL)
+			}
+		}
+		// Only carry credentials along to the same host, and never from
+		// https to cleartext http
+		downgrade := orig.URL.Scheme == "https" && req.URL.Scheme != "https"
+		if req.URL.Host == orig.URL.Host && !downgrade {
+			if auth := orig.Header.Get("Authorization"); auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+		} else {
+			req.Header.Del("Authorization")
+		}
+		return nil
+	}
 }
 
 func (host *Host) Login(username, password string) error {
@@ -47,10 +348,136 @@ func (host *Host) Login(username, password string) error {
 	return nil
 }
 
+// VerifyCredentials makes a lightweight authenticated HTTP GET to the
+// framework server in order to check the credentials provided to Login.
+// It returns nil if they are accepted, or else an *HTTPError, which matches
+// ErrUnauthorized with errors.Is if they are rejected.
+// This request has no side effects.
+func (host Host) VerifyCredentials() error {
+	uri := host.endpoint(rootAPISubPath, userSubPath)
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(host.user, host.pass)
+
+	resp, err := host.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !host.statusOK(resp) {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// endpoint builds the URI of a framework server resource by joining the
+// host's uri with the given path parts. Every part is joined with a single
+// slash, regardless of leading or trailing slashes on the host uri or the
+// parts. The leading slash of the path is always kept, so that a host
+// without a uri or scheme still yields an absolute path.
+func (host Host) endpoint(parts ...string) string {
+	uri := host.uri
+	for _, part := range parts {
+		uri = strings.TrimRight(uri, "/") + "/" + strings.Trim(part, "/")
+	}
+	return uri
+}
+
+// decodeResponse decodes the body of a successful response into v, unless the
+// response is a 204 No Content, which leaves v untouched
+func (host Host) decodeResponse(resp *http.Response, v interface{}) error {
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return host.decode(resp.Body, v)
+}
+
+// decode decodes the JSON response body r into v, as configured by the
+// host options
+func (host Host) decode(r io.Reader, v interface{}) error {
+	if host.errorField != "" {
+		var err error
+		if r, err = checkErrorField(r, host.errorField); err != nil {
+			return err
+		}
+	}
+	if host.ownerEncoding != OwnerEncodingAuto {
+		var err error
+		if r, err = checkOwnerEncoding(r, host.ownerEncoding); err != nil {
+			return err
+		}
+	}
+	return json.NewDecoder(r).Decode(v)
+}
+
+// ErrMissingTopic is returned when a node's pubsub endpoint has no topic
+var ErrMissingTopic = errors.New("Missing pubsub topic")
+
 // PubSub describes a node's pubsub endpoint
 type PubSub struct {
+	// Protocol is the pubsub protocol, which is "MQTT" for all current nodes
 	Protocol string `json:"protocol"`
-	Topic    string `json:"endpoint"`
+	// Topic is the node's base topic, like openchirp/device/<id>, which the
+	// node's other topics are built on
+	Topic string `json:"endpoint"`
+}
+
+// ParsePubSub decodes a JSON pubsub endpoint and validates it
+func ParsePubSub(data []byte) (PubSub, error) {
+	var pubsub PubSub
+	if err := json.Unmarshal(data, &pubsub); err != nil {
+		return pubsub, err
+	}
+	return pubsub, pubsub.Validate()
+}
+
+// Validate checks that the pubsub endpoint has a topic
+func (p PubSub) Validate() error {
+	if p.Topic == "" {
+		return ErrMissingTopic
+	}
+	return nil
+}
+
+// String renders the endpoint as "<protocol> <topic>"
+func (p PubSub) String() string {
+	if p.Protocol == "" {
+		return p.Topic
+	}
+	return p.Protocol + " " + p.Topic
+}
+
+// BrokerConfig describes the pubsub broker that the framework server
+// directs clients to
+type BrokerConfig struct {
+	URI  string `json:"broker"`
+	User string `json:"user,omitempty"` // Only if the broker has dedicated credentials
+	Pass string `json:"pass,omitempty"`
+}
+
+// RequestBrokerConfig makes an HTTP GET to the framework server requesting
+// the pubsub broker configuration
+func (host Host) RequestBrokerConfig() (BrokerConfig, error) {
+	var brokerConfig BrokerConfig
+	uri := host.endpoint(rootAPISubPath, pubsubSubPath)
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return brokerConfig, err
+	}
+	req.SetBasicAuth(host.user, host.pass)
+
+	resp, err := host.do(req)
+	if err != nil {
+		return brokerConfig, err
+	}
+	defer resp.Body.Close()
+	if !host.statusOK(resp) {
+		return brokerConfig, statusError(resp)
+	}
+	err = host.decodeResponse(resp, &brokerConfig)
+	return brokerConfig, err
 }
 
 // Owner describes the owning user's details
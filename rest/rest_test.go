@@ -0,0 +1,381 @@
+package rest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openchirp/framework/rest"
+)
+
+func TestHost_RedirectKeepsAuthOnSameHost(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apiv1/service/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/apiv1/service/new", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/apiv1/service/new", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "id" || pass != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":"new"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	host.Login("id", "token")
+
+	sInfo, err := host.RequestServiceInfo("old")
+	if err != nil {
+		t.Error("Error requesting redirected service info:", err)
+		return
+	}
+	if sInfo.ID != "new" {
+		t.Error("Unexpected service ID:", sInfo.ID)
+	}
+}
+
+func TestHost_RedirectRejectsDelete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/apiv1/service/old" {
+			http.Redirect(w, r, "/apiv1/service/new", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	host.Login("id", "token")
+
+	err := host.ServiceDelete("old")
+	if !errors.Is(err, rest.ErrRedirectNotFollowed) {
+		t.Error("Expected ErrRedirectNotFollowed, but got:", err)
+	}
+
+	host = rest.NewHost(server.URL, rest.WithUnsafeRedirects())
+	host.Login("id", "token")
+
+	// A 302 would turn the DELETE into a GET, so it must still be refused
+	err = host.ServiceDelete("old")
+	if !errors.Is(err, rest.ErrRedirectNotFollowed) {
+		t.Error("Expected ErrRedirectNotFollowed, but got:", err)
+	}
+}
+
+func TestHost_VerifyCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "id" || pass != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	host.Login("id", "token")
+	if err := host.VerifyCredentials(); err != nil {
+		t.Error("Unexpected error for good credentials:", err)
+	}
+
+	host.Login("id", "wrong")
+	if err := host.VerifyCredentials(); !errors.Is(err, rest.ErrUnauthorized) {
+		t.Error("Expected ErrUnauthorized, but got:", err)
+	}
+}
+
+func TestHost_EndpointSlashes(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	uris := []string{
+		server.URL,
+		server.URL + "/",
+		server.URL + "//",
+	}
+	for _, uri := range uris {
+		paths = nil
+		host := rest.NewHost(uri)
+		host.RequestServiceInfo("s1")
+		host.RequestServiceDeviceList("s1")
+		host.ServiceCreate("name", "description", nil, nil)
+		host.ServiceDelete("/s1/")
+
+		expected := []string{
+			"/apiv1/service/s1",
+			"/apiv1/service/s1/things",
+			"/apiv1/service",
+			"/apiv1/service/s1",
+		}
+		if len(paths) != len(expected) {
+			t.Errorf("Host uri %q made %d requests, expected %d", uri, len(paths), len(expected))
+			continue
+		}
+		for i := range expected {
+			if paths[i] != expected[i] {
+				t.Errorf("Host uri %q requested %q, expected %q", uri, paths[i], expected[i])
+			}
+		}
+	}
+
+	// without a uri, the path must stay absolute
+	for _, uri := range []string{"", "/"} {
+		_, err := rest.NewHost(uri).RequestServiceInfo("s1")
+		var urlErr *url.Error
+		if !errors.As(err, &urlErr) || urlErr.URL != "/apiv1/service/s1" {
+			t.Errorf("Host uri %q failed with %v, expected a request to /apiv1/service/s1", uri, err)
+		}
+	}
+}
+
+func TestHost_RequestID(t *testing.T) {
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("X-Request-ID"))
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	host.RequestServiceInfo("s1")
+	host.RequestServiceInfo("s1")
+	if len(ids) != 2 || len(ids[0]) != 36 || ids[0] == ids[1] {
+		t.Error("Expected two unique UUIDs, but got:", ids)
+	}
+
+	host = rest.NewHost(server.URL, rest.WithRequestIDGenerator(func() string { return "trace-1" }))
+	_, err := host.RequestServiceInfo("s1")
+	if err == nil || !strings.Contains(err.Error(), "trace-1") {
+		t.Error("Expected the request id in the error, but got:", err)
+	}
+}
+
+func TestHost_OperationTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		if strings.HasSuffix(r.URL.Path, "/things") {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHostWithLogin(server.URL, "user", "pass",
+		rest.WithTimeout(20*time.Millisecond),
+		rest.WithOperationTimeout(rest.OpRequestServiceDeviceList, 5*time.Second),
+	)
+	if _, err := host.RequestServiceInfo("s1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected the service info request to time out, but got:", err)
+	}
+	if err := host.ServiceDelete("s1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected the service delete to time out, but got:", err)
+	}
+	if _, err := host.RequestServiceDeviceList("s1"); err != nil {
+		t.Error("Unexpected device list error:", err)
+	}
+}
+
+func TestHost_Context(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	host := rest.NewHost(server.URL)
+	calls := map[string]func(ctx context.Context) error{
+		"RequestServiceInfoContext": func(ctx context.Context) error {
+			_, err := host.RequestServiceInfoContext(ctx, "s1")
+			return err
+		},
+		"RequestServiceDeviceListContext": func(ctx context.Context) error {
+			_, err := host.RequestServiceDeviceListContext(ctx, "s1")
+			return err
+		},
+		"ServiceCreateContext": func(ctx context.Context) error {
+			_, err := host.ServiceCreateContext(ctx, "name", "", nil, nil)
+			return err
+		},
+		"ServiceDeleteContext": func(ctx context.Context) error {
+			return host.ServiceDeleteContext(ctx, "s1")
+		},
+	}
+	for name, call := range calls {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		if err := call(ctx); err != context.Canceled {
+			t.Errorf("%s: expected context.Canceled, but got: %v", name, err)
+		}
+	}
+}
+
+func TestHost_HTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/apiv1/service/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"no such service"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	_, err := host.RequestServiceInfo("missing")
+	var httpErr *rest.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatal("Expected an HTTPError, but got:", err)
+	}
+	if httpErr.StatusCode != http.StatusNotFound || httpErr.Body != `{"message":"no such service"}` {
+		t.Error("Unexpected HTTPError:", httpErr.StatusCode, httpErr.Body)
+	}
+	if !errors.Is(err, rest.ErrNotFound) || errors.Is(err, rest.ErrUnauthorized) {
+		t.Error("HTTPError does not match its status:", err)
+	}
+
+	err = host.ServiceDelete("s1")
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusInternalServerError {
+		t.Error("Expected a 500 HTTPError, but got:", err)
+	}
+	if errors.Is(err, rest.ErrNotFound) {
+		t.Error("A 500 must not match ErrNotFound")
+	}
+}
+
+func TestHost_Retry(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		n := requests
+		lock.Unlock()
+		switch {
+		case r.URL.Path == "/apiv1/service/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case n < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"id":"s1"}`))
+		}
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL, rest.WithRetry(3, time.Millisecond))
+	if sNode, err := host.RequestServiceInfo("s1"); err != nil || sNode.ID != "s1" {
+		t.Error("Expected the third attempt to succeed, but got:", sNode, err)
+	}
+	if requests != 3 {
+		t.Error("Unexpected number of attempts:", requests)
+	}
+
+	// client errors are never retried
+	requests = 0
+	if _, err := host.RequestServiceInfo("missing"); !errors.Is(err, rest.ErrNotFound) {
+		t.Error("Expected ErrNotFound, but got:", err)
+	}
+	if requests != 1 {
+		t.Error("A 404 was retried:", requests)
+	}
+
+	// retries stop with the context
+	requests = 0
+	host = rest.NewHost(server.URL, rest.WithRetry(10, time.Hour))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := host.RequestServiceInfoContext(ctx, "s1"); err != context.Canceled {
+		t.Error("Expected context.Canceled, but got:", err)
+	}
+}
+
+func TestHost_Logger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"s1"}`))
+	}))
+	defer server.Close()
+
+	// nothing is printed to stdout by default
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	host := rest.NewHost(server.URL)
+	host.ServiceCreate("name", "", map[string]string{"secret": "hunter2"}, nil)
+	host.RequestDeviceInfo("d1")
+	os.Stdout = stdout
+	w.Close()
+	printed, _ := ioutil.ReadAll(r)
+	if len(printed) != 0 {
+		t.Errorf("Unexpected output on stdout: %q", printed)
+	}
+
+	var buf bytes.Buffer
+	host = rest.NewHost(server.URL, rest.WithLogger(log.New(&buf, "", 0)))
+	host.ServiceCreate("name", "", map[string]string{"secret": "hunter2"}, nil)
+	if !strings.Contains(buf.String(), "POST "+server.URL+"/apiv1/service") {
+		t.Errorf("Request was not logged: %q", buf.String())
+	}
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("Request body was logged: %q", buf.String())
+	}
+}
+
+func TestHost_ErrorField(t *testing.T) {
+	body := `{"error":"service not found"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	// by default, the error object is decoded like any other response
+	host := rest.NewHost(server.URL)
+	if _, err := host.RequestServiceInfo("s1"); err != nil {
+		t.Error("Unexpected error without error detection:", err)
+	}
+
+	host = rest.NewHost(server.URL, rest.WithErrorField("error"))
+	_, err := host.RequestServiceInfo("s1")
+	if !errors.Is(err, rest.ErrServerError) || !strings.Contains(err.Error(), "service not found") {
+		t.Error("Expected ErrServerError, but got:", err)
+	}
+
+	body = `{"id":"s1","error":null}`
+	if sNode, err := host.RequestServiceInfo("s1"); err != nil || sNode.ID != "s1" {
+		t.Error("Unexpected result for a null error field:", sNode, err)
+	}
+}
+
+func TestParsePubSub(t *testing.T) {
+	pubsub, err := rest.ParsePubSub([]byte(`{"protocol":"MQTT","endpoint":"openchirp/device/d1"}`))
+	if err != nil {
+		t.Fatal("Error parsing pubsub:", err)
+	}
+	if pubsub.String() != "MQTT openchirp/device/d1" {
+		t.Error("Unexpected pubsub string:", pubsub)
+	}
+
+	if _, err := rest.ParsePubSub([]byte(`{"protocol":"MQTT"}`)); err != rest.ErrMissingTopic {
+		t.Error("Expected ErrMissingTopic, but got:", err)
+	}
+}
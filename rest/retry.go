@@ -0,0 +1,69 @@
+package rest
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// WithRetry retries the idempotent requests RequestServiceInfo and
+// RequestServiceDeviceList, which allows riding out a framework server that
+// briefly fails, like during a deploy. A request is made up to maxAttempts
+// times in total. Only network errors and 5xx responses are retried, never
+// 4xx responses.
+//
+// The delay before a retry starts at baseDelay and doubles for every further
+// attempt. Each delay is randomized to between half and all of its value, so
+// that many services restarting at once do not retry in lockstep.
+// Retries stop once the request's context is done, like for the Context
+// method variants.
+func WithRetry(maxAttempts int, baseDelay time.Duration) HostOption {
+	return func(host *Host) {
+		host.retryAttempts = maxAttempts
+		host.retryDelay = baseDelay
+	}
+}
+
+// doRetry is like doOp, but retries the request as configured by WithRetry.
+// The request must not have a body.
+func (host Host) doRetry(op Operation, req *http.Request) (*http.Response, error) {
+	delay := host.retryDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := host.doOp(op, req)
+		if attempt >= host.retryAttempts || !retryable(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(jitter(delay))
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		delay *= 2
+	}
+}
+
+// retryable tells if the outcome of a request is a transient failure
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= 500
+}
+
+// jitter randomizes delay to between half and all of its value
+func jitter(delay time.Duration) time.Duration {
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
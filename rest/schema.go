@@ -0,0 +1,147 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+// configParametersKey is the service node's JSON key for the config parameters
+const configParametersKey = "config_required"
+
+// ConfigParameterSchema names the JSON fields of a config parameter object,
+// for integrating with framework servers that use a customized schema.
+// Empty names keep the default field name.
+type ConfigParameterSchema struct {
+	Name        string
+	Description string
+	Example     string
+	Required    string
+	Type        string
+	Options     string
+	Default     string
+}
+
+// DefaultConfigParameterSchema returns the field names used by the framework
+// server, which match the json tags of ServiceConfigParameter
+func DefaultConfigParameterSchema() ConfigParameterSchema {
+	return ConfigParameterSchema{
+		Name:        "key_name",
+		Description: "key_description",
+		Example:     "key_example",
+		Required:    "key_required",
+		Type:        "key_type",
+		Options:     "key_options",
+		Default:     "key_default",
+	}
+}
+
+// fields returns the field names in a fixed order, with empty names
+// replaced by the defaults
+func (s ConfigParameterSchema) fields() []string {
+	d := DefaultConfigParameterSchema()
+	fields := []string{s.Name, s.Description, s.Example, s.Required, s.Type, s.Options, s.Default}
+	defaults := []string{d.Name, d.Description, d.Example, d.Required, d.Type, d.Options, d.Default}
+	for i := range fields {
+		if fields[i] == "" {
+			fields[i] = defaults[i]
+		}
+	}
+	return fields
+}
+
+// WithConfigParameterSchema makes the host translate the config parameters of
+// all service requests and responses to and from the given field names,
+// instead of the default key_name, key_description, and so on.
+func WithConfigParameterSchema(schema ConfigParameterSchema) HostOption {
+	return func(host *Host) {
+		host.paramSchema = &schema
+	}
+}
+
+// remapConfigParameters renames the fields of the config parameter objects
+// within the JSON service object doc, from one schema's names to another's.
+// Other fields are left untouched.
+func remapConfigParameters(doc []byte, from, to ConfigParameterSchema) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(doc, &obj); err != nil {
+		return nil, err
+	}
+	var params []map[string]json.RawMessage
+	if err := json.Unmarshal(obj[configParametersKey], &params); err != nil || params == nil {
+		// nothing to remap, let the regular decoding report problems
+		return doc, nil
+	}
+
+	fromFields, toFields := from.fields(), to.fields()
+	for i, param := range params {
+		remapped := make(map[string]json.RawMessage, len(param))
+		for key, value := range param {
+			for j := range fromFields {
+				if key == fromFields[j] {
+					key = toFields[j]
+					break
+				}
+			}
+			remapped[key] = value
+		}
+		params[i] = remapped
+	}
+
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	obj[configParametersKey] = raw
+	return json.Marshal(obj)
+}
+
+// decodeServiceNode decodes a service node response, translating the config
+// parameters from the schema set by WithConfigParameterSchema
+func (host Host) decodeServiceNode(resp *http.Response, node *ServiceNode) error {
+	if host.paramSchema == nil || resp.StatusCode == http.StatusNoContent {
+		return host.decodeResponse(resp, node)
+	}
+	doc, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	doc, err = remapConfigParameters(doc, *host.paramSchema, DefaultConfigParameterSchema())
+	if err != nil {
+		return err
+	}
+	return host.decode(bytes.NewReader(doc), node)
+}
+
+// decodeServiceNodes decodes a response with a list of service nodes, like
+// decodeServiceNode
+func (host Host) decodeServiceNodes(resp *http.Response, nodes *[]ServiceNode) error {
+	if host.paramSchema == nil || resp.StatusCode == http.StatusNoContent {
+		return host.decodeResponse(resp, nodes)
+	}
+	var docs []json.RawMessage
+	if err := host.decode(resp.Body, &docs); err != nil {
+		return err
+	}
+	*nodes = make([]ServiceNode, len(docs))
+	for i, doc := range docs {
+		doc, err := remapConfigParameters(doc, *host.paramSchema, DefaultConfigParameterSchema())
+		if err != nil {
+			return err
+		}
+		if err := host.decode(bytes.NewReader(doc), &(*nodes)[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeServiceRequest translates the config parameters of a service
+// request body to the schema set by WithConfigParameterSchema
+func (host Host) encodeServiceRequest(body []byte) ([]byte, error) {
+	if host.paramSchema == nil {
+		return body, nil
+	}
+	return remapConfigParameters(body, DefaultConfigParameterSchema(), *host.paramSchema)
+}
@@ -5,9 +5,19 @@ package rest
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // ServiceNode is a container for Service Node object received
@@ -18,6 +28,25 @@ type ServiceNode struct {
 	Description      string                   `json:"description"`
 	Properties       map[string]string        `json:"properties"`
 	ConfigParameters []ServiceConfigParameter `json:"config_required"`
+	Version          int                      `json:"__v"` // Revision of the service document
+}
+
+// Service property keys that describe the service's MQTT broker
+const (
+	PropertyMQTTBroker = "MQTTBroker"
+	PropertyMQTTUser   = "MQTTUser"
+	PropertyMQTTPass   = "MQTTPass"
+	PropertyMQTTQos    = "MQTTQos"
+)
+
+// mqttBrokerSchemes are the broker URI schemes supported by the MQTT client
+var mqttBrokerSchemes = map[string]bool{
+	"tcp":  true,
+	"ssl":  true,
+	"tls":  true,
+	"tcps": true,
+	"ws":   true,
+	"wss":  true,
 }
 
 // ServiceCreateRequest encapsulates the data for a request to create a service
@@ -60,17 +89,92 @@ Services Device Config Responses Look Like The Following:
 // topic related to a service
 type ServicePubSub struct {
 	PubSub
+	// TopicEvents is where the framework server publishes the device link,
+	// update, and unlink events of the service
 	TopicEvents string `json:"events_endpoint"`
+	// TopicStatus is where the service publishes its status messages
 	TopicStatus string `json:"status_endpoint"`
 }
 
+// Validate checks that the service's pubsub endpoint has a topic
+func (p ServicePubSub) Validate() error {
+	return p.PubSub.Validate()
+}
+
+// String renders the endpoint along with the events and status topics
+func (p ServicePubSub) String() string {
+	return fmt.Sprintf("%v (events %s, status %s)", p.PubSub, p.TopicEvents, p.TopicStatus)
+}
+
 // ServiceConfigParameter represents one required config parameter from the
 // service's information or create service request.
 type ServiceConfigParameter struct {
-	Name        string `json:"key_name"` // The key_ is redundant
-	Description string `json:"key_description"`
-	Example     string `json:"key_example"`
-	Required    bool   `json:"key_required"`
+	Name        string        `json:"key_name"` // The key_ is redundant
+	Description string        `json:"key_description"`
+	Example     string        `json:"key_example"`
+	Required    bool          `json:"key_required"`
+	Type        ParameterType `json:"key_type,omitempty"`    // Only if provided by the server
+	Options     []string      `json:"key_options,omitempty"` // Allowed values for TypeEnum
+	Default     string        `json:"key_default,omitempty"` // Only if provided by the server
+}
+
+// ParameterType is the declared value type of a ServiceConfigParameter
+type ParameterType string
+
+// The ServiceConfigParameter value types. An empty type is treated as
+// TypeString.
+const (
+	TypeString ParameterType = "string"
+	TypeInt    ParameterType = "int"
+	TypeBool   ParameterType = "bool"
+	TypeEnum   ParameterType = "enum"
+)
+
+// ErrInvalidConfigValue is returned (wrapped) when a device config value does
+// not match its config parameter's declared type
+var ErrInvalidConfigValue = errors.New("Invalid config value")
+
+// ValidateValue checks that value is acceptable for the config parameter's
+// declared type. An empty value is only rejected if the parameter is required.
+// Unknown types, possibly from a newer server, accept any value.
+func (p ServiceConfigParameter) ValidateValue(value string) error {
+	if value == "" {
+		if p.Required {
+			return fmt.Errorf("%w: %s is required", ErrInvalidConfigValue, p.Name)
+		}
+		return nil
+	}
+	switch p.Type {
+	case TypeInt:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("%w: %s must be an integer, got %q", ErrInvalidConfigValue, p.Name, value)
+		}
+	case TypeBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%w: %s must be a boolean, got %q", ErrInvalidConfigValue, p.Name, value)
+		}
+	case TypeEnum:
+		for _, option := range p.Options {
+			if value == option {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s must be one of %s, got %q",
+			ErrInvalidConfigValue, p.Name, strings.Join(p.Options, ", "), value)
+	}
+	return nil
+}
+
+// ConfigParameterValue pairs a service's declared config parameter with the
+// value that a device provides for it
+type ConfigParameterValue struct {
+	Parameter ServiceConfigParameter
+	Value     string
+	// Present indicates if the device's config contains the parameter's key
+	Present bool
+	// Missing indicates if the parameter is required, but the device's
+	// config does not provide a value for it
+	Missing bool
 }
 
 // KeyValuePair represents the REST interface's internal structure for
@@ -80,10 +184,49 @@ type KeyValuePair struct {
 	Value string `json:"value"`
 }
 
+// UnmarshalJSON parses a KeyValuePair, while also accepting a JSON number or
+// boolean as the value. These are kept as their exact JSON text, so that
+// large integers, like 64-bit device identifiers, do not lose precision.
+func (p *KeyValuePair) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	p.Key = raw.Key
+	p.Value = ""
+
+	value := bytes.TrimSpace(raw.Value)
+	switch {
+	case len(value) == 0 || bytes.Equal(value, []byte("null")):
+	case value[0] == '"':
+		return json.Unmarshal(value, &p.Value)
+	default:
+		var v interface{}
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err != nil {
+			return err
+		}
+		switch v := v.(type) {
+		case json.Number:
+			p.Value = v.String()
+		case bool:
+			p.Value = string(value)
+		default:
+			return fmt.Errorf("Unsupported value for key %q: %s", p.Key, value)
+		}
+	}
+	return nil
+}
+
 // ServiceDeviceListItem represents the device and service configuration pair
 // found in a Service Node's device list
 type ServiceDeviceListItem struct {
 	Id     string         `json:"id"`
+	Name   string         `json:"name"` // Only if provided by the server
 	PubSub PubSub         `json:"pubsub"`
 	Config []KeyValuePair `json:"config"`
 }
@@ -99,6 +242,226 @@ func (i ServiceDeviceListItem) GetConfigMap() map[string]string {
 	}
 	return m
 }
+
+// GetConfigValueFold returns the device config value for key, ignoring the
+// case of the config keys. See LookupFold.
+func (i ServiceDeviceListItem) GetConfigValueFold(key string) (string, bool) {
+	return LookupFold(i.GetConfigMap(), key)
+}
+
+// LookupFold looks up key in m, tolerating keys that were entered with
+// inconsistent casing, like "MqttBroker" for "MQTTBroker".
+// An exact match is always preferred. Otherwise, the value of the
+// case-insensitive match is returned. If there are several such matches, the
+// value of the lexicographically smallest key is used, so that the result is
+// stable.
+func LookupFold(m map[string]string, key string) (string, bool) {
+	if value, ok := m[key]; ok {
+		return value, true
+	}
+	var match string
+	found := false
+	for k := range m {
+		if strings.EqualFold(k, key) && (!found || k < match) {
+			match = k
+			found = true
+		}
+	}
+	if !found {
+		return "", false
+	}
+	return m[match], true
+}
+
+// ErrPartialCredentials is returned (wrapped) when only one of the MQTT user
+// and password is configured, which would otherwise silently connect to the
+// broker anonymously
+var ErrPartialCredentials = errors.New("Partial MQTT credentials")
+
+// Clone returns a deep copy of the service node, so that changes to the
+// copy's properties or config parameters do not affect the original
+func (n ServiceNode) Clone() ServiceNode {
+	clone := n
+	if n.Properties != nil {
+		clone.Properties = make(map[string]string, len(n.Properties))
+		for key, value := range n.Properties {
+			clone.Properties[key] = value
+		}
+	}
+	if n.ConfigParameters != nil {
+		clone.ConfigParameters = make([]ServiceConfigParameter, len(n.ConfigParameters))
+		for i, param := range n.ConfigParameters {
+			if param.Options != nil {
+				param.Options = append([]string(nil), param.Options...)
+			}
+			clone.ConfigParameters[i] = param
+		}
+	}
+	return clone
+}
+
+// ValidateMQTTProperties checks that the service's MQTT related properties
+// are consistent, so that a misconfigured service can be reported before
+// trying to connect to the broker.
+// The MQTTBroker property must be a parseable URI with a supported scheme
+// (tcp, ssl, tls, tcps, ws, or wss) or a plain host:port, which implies tcp.
+// Since it is not known whether the broker requires authentication, the
+// credentials are only checked to be either both present or both absent.
+func (n ServiceNode) ValidateMQTTProperties() error {
+	broker := n.Properties[PropertyMQTTBroker]
+	if broker == "" {
+		return fmt.Errorf("Missing %s property", PropertyMQTTBroker)
+	}
+	if !strings.Contains(broker, "://") {
+		broker = "tcp://" + broker
+	}
+	u, err := url.Parse(broker)
+	if err != nil {
+		return fmt.Errorf("Invalid %s property: %v", PropertyMQTTBroker, err)
+	}
+	if !mqttBrokerSchemes[u.Scheme] {
+		return fmt.Errorf("Unsupported %s property scheme %q", PropertyMQTTBroker, u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("Missing host in %s property", PropertyMQTTBroker)
+	}
+
+	return n.CheckMQTTCredentials()
+}
+
+// CheckMQTTCredentials makes sure that the MQTTUser and MQTTPass properties
+// are either both present or both absent. ErrPartialCredentials is returned
+// otherwise.
+func (n ServiceNode) CheckMQTTCredentials() error {
+	user := n.Properties[PropertyMQTTUser]
+	pass := n.Properties[PropertyMQTTPass]
+	if (user == "") != (pass == "") {
+		return fmt.Errorf("%w: only one of the %s and %s properties is set",
+			ErrPartialCredentials, PropertyMQTTUser, PropertyMQTTPass)
+	}
+	return nil
+}
+
+// ConfigParameterByName returns the service's config parameter with the given
+// name. The bool is false if the service declares no such parameter.
+// For repeated lookups, use ConfigParameterMap instead.
+func (n ServiceNode) ConfigParameterByName(name string) (ServiceConfigParameter, bool) {
+	for _, param := range n.ConfigParameters {
+		if param.Name == name {
+			return param, true
+		}
+	}
+	return ServiceConfigParameter{}, false
+}
+
+// ConfigParameterMap returns the service's config parameters keyed by name.
+// The map is built once per call, so callers doing many lookups, like when
+// validating many device configs, should keep the returned map around.
+func (n ServiceNode) ConfigParameterMap() map[string]ServiceConfigParameter {
+	m := make(map[string]ServiceConfigParameter, len(n.ConfigParameters))
+	for _, param := range n.ConfigParameters {
+		m[param.Name] = param
+	}
+	return m
+}
+
+// ExampleConfig builds a sample device config for this service from each
+// config parameter's Example value. It can be marshaled to JSON to give users
+// a ready to edit config for linking a device.
+func (n ServiceNode) ExampleConfig() map[string]string {
+	config := make(map[string]string, len(n.ConfigParameters))
+	for _, param := range n.ConfigParameters {
+		config[param.Name] = param.Example
+	}
+	return config
+}
+
+// ConfigParameterValues pairs each of the service's declared config parameters
+// with the value provided in a device's config. A device config key maps to
+// the parameter with the exact same Name. Required parameters that are absent
+// or empty in the device config are flagged as Missing.
+// The result is in the order of the service's ConfigParameters.
+func (n ServiceNode) ConfigParameterValues(item ServiceDeviceListItem) []ConfigParameterValue {
+	config := item.GetConfigMap()
+	values := make([]ConfigParameterValue, len(n.ConfigParameters))
+	for i, param := range n.ConfigParameters {
+		value, present := config[param.Name]
+		values[i] = ConfigParameterValue{
+			Parameter: param,
+			Value:     value,
+			Present:   present,
+			Missing:   param.Required && value == "",
+		}
+	}
+	return values
+}
+
+// ErrUnknownConfigKey is returned (wrapped) when a device config contains a
+// key that is not one of the service's config parameters
+var ErrUnknownConfigKey = errors.New("Unknown config key")
+
+// ConfigErrors lists all of the problems found in a device config
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ValidateDeviceConfig checks a device config against the service's config
+// parameters. Every parameter's value is checked with ValidateValue, which
+// catches missing required keys and type mismatches, and keys that are not
+// declared parameters are reported with ErrUnknownConfigKey.
+// All problems are returned together as ConfigErrors, or nil if there are
+// none.
+func (n ServiceNode) ValidateDeviceConfig(config map[string]string) error {
+	var errs ConfigErrors
+	declared := make(map[string]bool, len(n.ConfigParameters))
+	for _, param := range n.ConfigParameters {
+		declared[param.Name] = true
+		if err := param.ValidateValue(config[param.Name]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var unknown []string
+	for key := range config {
+		if !declared[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrUnknownConfigKey, key))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// CheckConfigParameters verifies that no two config parameters share the
+// same name. An error listing the duplicated names is returned otherwise.
+func CheckConfigParameters(configParams []ServiceConfigParameter) error {
+	seen := make(map[string]int, len(configParams))
+	for _, p := range configParams {
+		seen[p.Name]++
+	}
+	var dups []string
+	for name, count := range seen {
+		if count > 1 {
+			dups = append(dups, fmt.Sprintf("%q", name))
+		}
+	}
+	if len(dups) > 0 {
+		sort.Strings(dups)
+		return fmt.Errorf("Duplicate config parameter names: %s", strings.Join(dups, ", "))
+	}
+	return nil
+}
+
 func (n ServiceDeviceListItem) String() string {
 	buf, _ := json.MarshalIndent(&n, "", jsonPrettyIndent)
 	return string(buf)
@@ -123,61 +486,383 @@ func (n KeyValuePair) String() string {
 
 // RequestServiceInfo makes an HTTP GET to the framework server requesting
 // the Service Node information for service with ID serviceid.
+// The result may come from the cache enabled by WithServiceInfoCache.
 func (host Host) RequestServiceInfo(serviceid string) (ServiceNode, error) {
+	return host.RequestServiceInfoContext(context.Background(), serviceid)
+}
+
+// RequestServiceInfoContext is like RequestServiceInfo, but the request is
+// aborted once ctx is done, in which case ctx's error is returned
+func (host Host) RequestServiceInfoContext(ctx context.Context, serviceid string) (ServiceNode, error) {
+	if host.serviceCache != nil {
+		if serviceNode, ok := host.serviceCache.get(host.user, serviceid); ok {
+			return serviceNode, nil
+		}
+	}
+	serviceNode, err := host.requestServiceInfo(ctx, serviceid)
+	if err == nil && host.serviceCache != nil {
+		host.serviceCache.add(host.user, serviceid, serviceNode)
+	}
+	return serviceNode, err
+}
+
+func (host Host) requestServiceInfo(ctx context.Context, serviceid string) (ServiceNode, error) {
 	var serviceNode ServiceNode
-	uri := host.uri + rootAPISubPath + servicesSubPath + "/" + serviceid
-	req, err := http.NewRequest("GET", uri, nil)
+	uri := host.endpoint(rootAPISubPath, servicesSubPath, serviceid)
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
 	if err != nil {
 		return serviceNode, err
 	}
 	req.SetBasicAuth(host.user, host.pass)
 
 	// resp, err := http.Get(host.uri + servicesSubPath + "/" + serviceid)
-	resp, err := host.client.Do(req)
+	resp, err := host.doRetry(OpRequestServiceInfo, req)
 	if err != nil {
 		// should report auth problems here in future
 		return serviceNode, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != httpStatusCodeOK {
-		return serviceNode, fmt.Errorf("%v", resp.Status)
+	if !host.statusOK(resp) {
+		return serviceNode, statusError(resp)
 	}
-	err = json.NewDecoder(resp.Body).Decode(&serviceNode)
+	err = host.decodeServiceNode(resp, &serviceNode)
 	return serviceNode, err
 }
 
-// RequestServiceDeviceList
+// RequestServiceDeviceList makes an HTTP GET to the framework server
+// requesting the list of devices linked to the service serviceid.
+// A service without devices always yields an empty, non-nil slice, even if
+// the server responds with null or an empty body.
 func (host Host) RequestServiceDeviceList(serviceid string) ([]ServiceDeviceListItem, error) {
+	return host.RequestServiceDeviceListContext(context.Background(), serviceid)
+}
+
+// RequestServiceDeviceListContext is like RequestServiceDeviceList, but the
+// request is aborted once ctx is done, in which case ctx's error is returned
+func (host Host) RequestServiceDeviceListContext(ctx context.Context, serviceid string) ([]ServiceDeviceListItem, error) {
+	devices, _, err := host.requestServiceDeviceList(ctx, serviceid, nil)
+	return devices, err
+}
+
+// RequestServiceDeviceListPaged makes an HTTP GET to the framework server
+// requesting a page of the list of devices linked to the service serviceid,
+// which starts at offset and holds at most limit devices. A limit of 0 or less
+// leaves the page size to the server's default, rather than requesting no
+// devices. It also returns the total number of linked devices, as reported by
+// the X-Total-Count header. If the server does not report it, the total is
+// estimated from the offset and the number of returned devices.
+func (host Host) RequestServiceDeviceListPaged(serviceid string, offset, limit int) ([]ServiceDeviceListItem, int, error) {
+	devices, total, err := host.requestServiceDeviceListPage(context.Background(), serviceid, offset, limit)
+	if err == nil && total < 0 {
+		total = offset + len(devices)
+	}
+	return devices, total, err
+}
+
+// requestServiceDeviceListPage requests a page of the device list like
+// RequestServiceDeviceListPaged, but the total is -1 if the server does not
+// report it
+func (host Host) requestServiceDeviceListPage(ctx context.Context, serviceid string, offset, limit int) ([]ServiceDeviceListItem, int, error) {
+	query := url.Values{}
+	if offset > 0 {
+		query.Set("offset", strconv.Itoa(offset))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	return host.requestServiceDeviceList(ctx, serviceid, query)
+}
+
+// StreamServiceDeviceList requests the list of devices linked to the service
+// serviceid page by page, with RequestServiceDeviceListPaged, and streams the
+// devices over the returned channel, which is closed after the last device.
+// A pageSize of 0 or less uses the server's default page size.
+// The error channel receives at most one error, which ends the stream, and
+// is closed along with the devices channel. The stream also ends once ctx is
+// done, in which case ctx's error is sent.
+// A server that ignores the paging is detected, by a page larger than
+// pageSize or a page that starts over with the first device, so that every
+// device is still streamed only once.
+func (host Host) StreamServiceDeviceList(ctx context.Context, serviceid string, pageSize int) (<-chan ServiceDeviceListItem, <-chan error) {
+	devices := make(chan ServiceDeviceListItem)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(devices)
+		offset := 0
+		first := ""
+		for {
+			page, total, err := host.requestServiceDeviceListPage(ctx, serviceid, offset, pageSize)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if len(page) > 0 {
+				if offset > 0 && page[0].Id == first {
+					// the server ignored the offset and started over
+					return
+				}
+				if offset == 0 {
+					first = page[0].Id
+				}
+			}
+			for _, device := range page {
+				select {
+				case devices <- device:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+			}
+			offset += len(page)
+			if len(page) == 0 || (total >= 0 && offset >= total) {
+				return
+			}
+			if pageSize > 0 && len(page) > pageSize {
+				// the server ignored the limit and sent the full list
+				return
+			}
+			if total < 0 && (pageSize <= 0 || len(page) < pageSize) {
+				// without a total, a short page is the last one
+				return
+			}
+		}
+	}()
+	return devices, errs
+}
+
+// requestServiceDeviceList requests the devices linked to the service
+// serviceid with the given query, which may be nil. The total is taken from
+// the X-Total-Count header and is -1 if the server does not report it.
+func (host Host) requestServiceDeviceList(ctx context.Context, serviceid string, query url.Values) ([]ServiceDeviceListItem, int, error) {
 	var serviceDeviceListItems = make([]ServiceDeviceListItem, 0)
-	uri := host.uri + rootAPISubPath + servicesSubPath + "/" + serviceid + serviceDevicesSubPath
-	req, err := http.NewRequest("GET", uri, nil)
+	uri := host.endpoint(rootAPISubPath, servicesSubPath, serviceid, serviceDevicesSubPath)
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
 	if err != nil {
-		return serviceDeviceListItems, err
+		return serviceDeviceListItems, 0, err
 	}
 	req.SetBasicAuth(host.user, host.pass)
 
-	resp, err := host.client.Do(req)
+	resp, err := host.doRetry(OpRequestServiceDeviceList, req)
 	if err != nil {
 		// should report auth problems here in future
-		return serviceDeviceListItems, err
+		return serviceDeviceListItems, 0, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != httpStatusCodeOK {
-		return serviceDeviceListItems, fmt.Errorf("%v", resp.Status)
+	if !host.statusOK(resp) {
+		return serviceDeviceListItems, 0, statusError(resp)
+	}
+	err = host.decodeResponse(resp, &serviceDeviceListItems)
+	if err == io.EOF {
+		// an empty body means no devices
+		err = nil
+	}
+	if serviceDeviceListItems == nil {
+		// a null body decodes to a nil slice
+		serviceDeviceListItems = make([]ServiceDeviceListItem, 0)
+	}
+	total, convErr := strconv.Atoi(resp.Header.Get(totalCountHeader))
+	if convErr != nil {
+		total = -1
+	}
+	return serviceDeviceListItems, total, err
+}
+
+// totalCountHeader carries the total number of items of a paginated listing
+const totalCountHeader = "X-Total-Count"
+
+// ServiceListFilter selects the services listed by RequestServiceListFiltered.
+// Zero fields do not filter.
+type ServiceListFilter struct {
+	// Name only lists services whose name contains this substring
+	Name string
+	// Owner only lists services owned by the user with this id
+	Owner string
+	// HasDevices only lists services with (true) or without (false) linked
+	// devices, if set
+	HasDevices *bool
+	// Offset skips this many services and Limit caps the number of services
+	// returned, for paginating through the listing
+	Offset int
+	Limit  int
+}
+
+// query builds the request query string of the filter
+func (f ServiceListFilter) query() url.Values {
+	query := url.Values{}
+	if f.Name != "" {
+		query.Set("name", f.Name)
+	}
+	if f.Owner != "" {
+		query.Set("owner", f.Owner)
+	}
+	if f.HasDevices != nil {
+		query.Set("has_devices", strconv.FormatBool(*f.HasDevices))
 	}
-	err = json.NewDecoder(resp.Body).Decode(&serviceDeviceListItems)
-	return serviceDeviceListItems, err
+	if f.Offset > 0 {
+		query.Set("offset", strconv.Itoa(f.Offset))
+	}
+	if f.Limit > 0 {
+		query.Set("limit", strconv.Itoa(f.Limit))
+	}
+	return query
+}
+
+// RequestServiceList makes an HTTP GET to the framework server requesting
+// all services that are visible to the user
+func (host Host) RequestServiceList() ([]ServiceNode, error) {
+	services, _, err := host.RequestServiceListFiltered(ServiceListFilter{})
+	return services, err
+}
+
+// RequestServiceListFiltered makes an HTTP GET to the framework server
+// requesting the services selected by filter, which is applied by the
+// server. It also returns the total number of services that match the filter,
+// regardless of the pagination, as reported by the X-Total-Count header.
+// If the server does not report it, the number of returned services is used.
+func (host Host) RequestServiceListFiltered(filter ServiceListFilter) ([]ServiceNode, int, error) {
+	var services = make([]ServiceNode, 0)
+	uri := host.endpoint(rootAPISubPath, servicesSubPath)
+	if query := filter.query(); len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return services, 0, err
+	}
+	req.SetBasicAuth(host.user, host.pass)
+
+	resp, err := host.doOp(OpRequestServiceList, req)
+	if err != nil {
+		return services, 0, err
+	}
+	defer resp.Body.Close()
+	if !host.statusOK(resp) {
+		return services, 0, statusError(resp)
+	}
+	err = host.decodeServiceNodes(resp, &services)
+	if services == nil {
+		services = make([]ServiceNode, 0)
+	}
+	if err != nil {
+		return services, 0, err
+	}
+	total, err := strconv.Atoi(resp.Header.Get(totalCountHeader))
+	if err != nil {
+		total = len(services)
+	}
+	return services, total, nil
+}
+
+// ServiceEvent is a persisted service event, like the operational events
+// that services publish to their log topic
+type ServiceEvent struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Level     string            `json:"level"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// RequestServiceEvents makes an HTTP GET to the framework server requesting
+// the recent events of the service serviceid, for troubleshooting after the
+// fact. Only events after since are returned, unless since is the zero time.
+// At most limit events are returned, unless limit is 0 or less, in which case
+// the server's default applies.
+func (host Host) RequestServiceEvents(serviceid string, since time.Time, limit int) ([]ServiceEvent, error) {
+	var events = make([]ServiceEvent, 0)
+	uri := host.endpoint(rootAPISubPath, servicesSubPath, serviceid, serviceEventsSubPath)
+	query := url.Values{}
+	if !since.IsZero() {
+		query.Set("since", since.UTC().Format(time.RFC3339Nano))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return events, err
+	}
+	req.SetBasicAuth(host.user, host.pass)
+
+	resp, err := host.doOp(OpRequestServiceEvents, req)
+	if err != nil {
+		return events, err
+	}
+	defer resp.Body.Close()
+	if !host.statusOK(resp) {
+		return events, statusError(resp)
+	}
+	err = host.decodeResponse(resp, &events)
+	if events == nil {
+		events = make([]ServiceEvent, 0)
+	}
+	return events, err
+}
+
+// ServiceCreateResult is the outcome of a successful ServiceCreateWithResult
+type ServiceCreateResult struct {
+	// Node is the created service
+	Node ServiceNode
+	// Warnings are the non-fatal issues reported by the framework server,
+	// like a property that was ignored or altered. It is nil if there were
+	// none.
+	Warnings []string
 }
 
 // ServiceCreate makes an HTTP POST request to the framework server
-// in order to create a new service with
+// in order to create a new service with the given name, description,
+// properties, and config parameters.
+// Config parameters with duplicate names are rejected before any request is
+// sent.
+// The returned node is decoded from the create response, unless the Host was
+// created with WithCreateRefetch.
+// Use ServiceCreateWithResult to also learn about the server's warnings.
 func (host Host) ServiceCreate(
 	name, description string,
 	properties map[string]string, // can be nil
 	configParams []ServiceConfigParameter, // can be nil
 ) (ServiceNode, error) {
-	var serviceNode ServiceNode
-	uri := host.uri + rootAPISubPath + servicesSubPath
+	return host.ServiceCreateContext(context.Background(), name, description, properties, configParams)
+}
+
+// ServiceCreateContext is like ServiceCreate, but the request is aborted
+// once ctx is done, in which case ctx's error is returned
+func (host Host) ServiceCreateContext(
+	ctx context.Context,
+	name, description string,
+	properties map[string]string, // can be nil
+	configParams []ServiceConfigParameter, // can be nil
+) (ServiceNode, error) {
+	result, err := host.serviceCreate(ctx, name, description, properties, configParams)
+	return result.Node, err
+}
+
+// ServiceCreateWithResult is like ServiceCreate, but also returns the
+// warnings that the framework server reported for the create. Warnings are
+// taken from the "warnings" string array of the response and from Warning
+// response headers.
+func (host Host) ServiceCreateWithResult(
+	name, description string,
+	properties map[string]string, // can be nil
+	configParams []ServiceConfigParameter, // can be nil
+) (ServiceCreateResult, error) {
+	return host.serviceCreate(context.Background(), name, description, properties, configParams)
+}
+
+func (host Host) serviceCreate(
+	ctx context.Context,
+	name, description string,
+	properties map[string]string,
+	configParams []ServiceConfigParameter,
+) (ServiceCreateResult, error) {
+	var result ServiceCreateResult
+	uri := host.endpoint(rootAPISubPath, servicesSubPath)
 	serviceReq := ServiceCreateRequest{
 		Name:        name,
 		Description: description,
@@ -186,53 +871,282 @@ func (host Host) ServiceCreate(
 		serviceReq.Properties = properties
 	}
 	if configParams != nil {
+		if err := CheckConfigParameters(configParams); err != nil {
+			return result, err
+		}
 		serviceReq.ConfigParameters = configParams
 	}
 	body, err := json.Marshal(&serviceReq)
+	if err == nil {
+		body, err = host.encodeServiceRequest(body)
+	}
+	if err != nil {
+		return result, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, bytes.NewReader(body))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.SetBasicAuth(host.user, host.pass)
+
+	resp, err := host.doOp(OpServiceCreate, req)
+	if err != nil {
+		// should report auth problems here in future
+		return result, err
+	}
+	defer resp.Body.Close()
+	if !host.statusOK(resp) {
+		return result, statusError(resp)
+	}
+
+	doc, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return result, err
+	}
+	result.Warnings = responseWarnings(resp.Header, doc)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(doc))
+	err = host.decodeServiceNode(resp, &result.Node)
+	if err != nil || !host.refetchCreated {
+		return result, err
+	}
+
+	// the create response may not be the complete service node
+	result.Node, err = host.RequestServiceInfoContext(ctx, result.Node.ID)
+	return result, err
+}
+
+// responseWarnings collects the warnings of a response from its Warning
+// headers, like 199 - "property X ignored", and from the "warnings" string
+// array of the JSON document doc
+func responseWarnings(header http.Header, doc []byte) []string {
+	var warnings []string
+	for _, value := range header["Warning"] {
+		warnings = append(warnings, warnText(value))
+	}
+	var body struct {
+		Warnings []string `json:"warnings"`
+	}
+	// the document may not be an object, which simply carries no warnings
+	if json.Unmarshal(doc, &body) == nil {
+		warnings = append(warnings, body.Warnings...)
+	}
+	return warnings
+}
+
+// warnText returns the quoted warn-text of a Warning header value, or the
+// whole value if it has none
+func warnText(value string) string {
+	start := strings.IndexByte(value, '"')
+	if start < 0 {
+		return value
+	}
+	var text strings.Builder
+	for i := start + 1; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if i++; i < len(value) {
+				text.WriteByte(value[i])
+			}
+		case '"':
+			return text.String()
+		default:
+			text.WriteByte(value[i])
+		}
+	}
+	return value
+}
+
+// ServiceUpdate makes an HTTP PUT request to the framework server
+// in order to edit the existing service serviceid. Only the given fields are
+// changed, so an empty name or description and nil properties or config
+// parameters leave the current values untouched.
+// The updated service is returned, like ServiceCreate does.
+// The last write wins, use ServiceUpdateVersion to detect concurrent changes.
+func (host Host) ServiceUpdate(
+	serviceid, name, description string,
+	properties map[string]string, // can be nil
+	configParams []ServiceConfigParameter, // can be nil
+) (ServiceNode, error) {
+	return host.serviceUpdate(serviceid, nil, name, description, properties, configParams)
+}
+
+// ServiceUpdateVersion is like ServiceUpdate, but only applies the update if
+// the service is still at the given version, as read from ServiceNode.Version.
+// The version is sent as an If-Match precondition. An *HTTPError matching
+// ErrConflict with errors.Is is returned if the service was changed in the
+// meantime, in which case the service should be read again and the change
+// reapplied.
+func (host Host) ServiceUpdateVersion(
+	serviceid string,
+	version int,
+	name, description string,
+	properties map[string]string, // can be nil
+	configParams []ServiceConfigParameter, // can be nil
+) (ServiceNode, error) {
+	return host.serviceUpdate(serviceid, &version, name, description, properties, configParams)
+}
+
+func (host Host) serviceUpdate(
+	serviceid string,
+	version *int,
+	name, description string,
+	properties map[string]string,
+	configParams []ServiceConfigParameter,
+) (ServiceNode, error) {
+	var serviceNode ServiceNode
+	uri := host.endpoint(rootAPISubPath, servicesSubPath, serviceid)
+	defer host.InvalidateServiceInfo(serviceid)
+
+	// only send the fields that should change
+	serviceReq := make(map[string]interface{})
+	if name != "" {
+		serviceReq["name"] = name
+	}
+	if description != "" {
+		serviceReq["description"] = description
+	}
+	if properties != nil {
+		serviceReq["properties"] = properties
+	}
+	if configParams != nil {
+		if err := CheckConfigParameters(configParams); err != nil {
+			return serviceNode, err
+		}
+		serviceReq["config_required"] = configParams
+	}
+	if version != nil {
+		serviceReq["__v"] = *version
+	}
+	body, err := json.Marshal(serviceReq)
+	if err == nil {
+		body, err = host.encodeServiceRequest(body)
+	}
 	if err != nil {
 		return serviceNode, err
 	}
-	fmt.Println("Request is:", string(body))
-	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
+	req, err := http.NewRequest("PUT", uri, bytes.NewReader(body))
 	if err != nil {
 		return serviceNode, err
 	}
 	req.Header.Add("Content-Type", "application/json")
+	if version != nil {
+		req.Header.Add("If-Match", strconv.Quote(strconv.Itoa(*version)))
+	}
 	req.SetBasicAuth(host.user, host.pass)
 
-	resp, err := host.client.Do(req)
+	resp, err := host.doOp(OpServiceUpdate, req)
 	if err != nil {
-		// should report auth problems here in future
 		return serviceNode, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != httpStatusCodeOK {
-		return serviceNode, fmt.Errorf("%v", resp.Status)
+	if !host.statusOK(resp) {
+		return serviceNode, statusError(resp)
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&serviceNode)
-
+	err = host.decodeServiceNode(resp, &serviceNode)
 	return serviceNode, err
 }
 
+// ErrEmptyServiceName is returned when renaming a service to an empty name
+var ErrEmptyServiceName = errors.New("Empty service name")
+
+// ServiceRename changes the name of the existing service serviceid, keeping
+// its id, device links and all other fields, and returns the updated service.
+// It is a shorthand for ServiceUpdate with only the name set.
+func (host Host) ServiceRename(serviceid, newName string) (ServiceNode, error) {
+	if newName == "" {
+		return ServiceNode{}, ErrEmptyServiceName
+	}
+	return host.ServiceUpdate(serviceid, newName, "", nil, nil)
+}
+
 // ServiceDelete makes an HTTP DELETE request to the framework server
 // on the specified serviceid
 func (host Host) ServiceDelete(serviceid string) error {
-	uri := host.uri + rootAPISubPath + servicesSubPath + "/" + serviceid
+	return host.ServiceDeleteContext(context.Background(), serviceid)
+}
+
+// ServiceDeleteContext is like ServiceDelete, but the request is aborted
+// once ctx is done, in which case ctx's error is returned
+func (host Host) ServiceDeleteContext(ctx context.Context, serviceid string) error {
+	uri := host.endpoint(rootAPISubPath, servicesSubPath, serviceid)
+	defer host.InvalidateServiceInfo(serviceid)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(host.user, host.pass)
+
+	resp, err := host.doOp(OpServiceDelete, req)
+	if err != nil {
+		// should report auth problems here in future
+		return err
+	}
+	defer resp.Body.Close()
+	if !host.statusOK(resp) {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// ServiceUnlinkDevice makes an HTTP DELETE request to the framework server
+// in order to unlink the service serviceid from the device deviceid
+func (host Host) ServiceUnlinkDevice(serviceid, deviceid string) error {
+	uri := host.endpoint(rootAPISubPath, deviceSubPath, deviceid, servicesSubPath, serviceid)
 	req, err := http.NewRequest("DELETE", uri, nil)
 	if err != nil {
 		return err
 	}
 	req.SetBasicAuth(host.user, host.pass)
 
-	resp, err := host.client.Do(req)
+	resp, err := host.do(req)
 	if err != nil {
 		// should report auth problems here in future
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != httpStatusCodeOK {
-		return fmt.Errorf("%v", resp.Status)
+	if !host.statusOK(resp) {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// ServiceUnlinkAllDevices unlinks all devices from the service serviceid.
+// It fetches the service's device list and unlinks the devices concurrently,
+// with a bounded number of requests in flight.
+// All devices are attempted, even if some fail. The failures are returned
+// together as DeviceErrors.
+//
+// This is intended to be used before ServiceDelete, in order to cleanly
+// decommission a service.
+func (host Host) ServiceUnlinkAllDevices(serviceid string) error {
+	devices, err := host.RequestServiceDeviceList(serviceid)
+	if err != nil {
+		return err
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(DeviceErrors)
+	sem := make(chan struct{}, deviceOpsConcurrency)
+	for _, dev := range devices {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(deviceid string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := host.ServiceUnlinkDevice(serviceid, deviceid); err != nil {
+				lock.Lock()
+				errs[deviceid] = err
+				lock.Unlock()
+			}
+		}(dev.Id)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
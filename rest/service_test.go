@@ -1,8 +1,18 @@
 package rest_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/openchirp/framework/rest"
 )
@@ -74,3 +84,668 @@ func TestHost_ServiceCreateAndDelete(t *testing.T) {
 		return
 	}
 }
+
+func TestCheckConfigParameters(t *testing.T) {
+	params := []rest.ServiceConfigParameter{
+		{Name: "DevEUI"},
+		{Name: "AppEUI"},
+	}
+	if err := rest.CheckConfigParameters(params); err != nil {
+		t.Error("Unexpected error for unique names:", err)
+	}
+
+	params = append(params, rest.ServiceConfigParameter{Name: "DevEUI"})
+	err := rest.CheckConfigParameters(params)
+	if err == nil {
+		t.Error("Expected an error for duplicate names")
+		return
+	}
+	if !strings.Contains(err.Error(), `"DevEUI"`) {
+		t.Error("Error does not list the duplicate name:", err)
+	}
+	if strings.Contains(err.Error(), `"AppEUI"`) {
+		t.Error("Error lists a unique name:", err)
+	}
+}
+
+func TestHost_ServiceUnlinkAllDevices(t *testing.T) {
+	var lock sync.Mutex
+	unlinked := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/apiv1/service/s1/things":
+			w.Write([]byte(`[{"id":"d1"},{"id":"d2"},{"id":"d3"}]`))
+		case r.Method == "DELETE" && r.URL.Path == "/apiv1/device/d2/service/s1":
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.Method == "DELETE" && strings.HasSuffix(r.URL.Path, "/service/s1"):
+			lock.Lock()
+			unlinked[strings.Split(r.URL.Path, "/")[3]] = true
+			lock.Unlock()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	err := host.ServiceUnlinkAllDevices("s1")
+	errs, ok := err.(rest.DeviceErrors)
+	if !ok {
+		t.Error("Expected DeviceErrors, but got:", err)
+		return
+	}
+	if len(errs) != 1 || errs["d2"] == nil {
+		t.Error("Unexpected device errors:", errs)
+	}
+	if !unlinked["d1"] || !unlinked["d3"] {
+		t.Error("Not all devices were unlinked:", unlinked)
+	}
+}
+
+func TestKeyValuePair_UnmarshalJSONNumber(t *testing.T) {
+	var pairs []rest.KeyValuePair
+	data := `[{"key":"DevEUI","value":18446744073709551615},{"key":"AppEUI","value":"test"},{"key":"ADR","value":true}]`
+	if err := json.Unmarshal([]byte(data), &pairs); err != nil {
+		t.Error("Error unmarshaling key value pairs:", err)
+		return
+	}
+	if pairs[0].Value != "18446744073709551615" {
+		t.Error("Number value lost precision:", pairs[0].Value)
+	}
+	if pairs[1].Value != "test" {
+		t.Error("Unexpected string value:", pairs[1].Value)
+	}
+	if pairs[2].Value != "true" {
+		t.Error("Unexpected bool value:", pairs[2].Value)
+	}
+}
+
+func TestHost_ServiceUpdateVersion(t *testing.T) {
+	const currentVersion = 3
+	var lastBody map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/apiv1/service/s1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		lastBody = nil
+		json.NewDecoder(r.Body).Decode(&lastBody)
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != `"3"` {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.Write([]byte(`{"id":"s1","name":"renamed","__v":4}`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+
+	sNode, err := host.ServiceUpdateVersion("s1", currentVersion, "renamed", "", nil, nil)
+	if err != nil {
+		t.Fatal("Error updating service:", err)
+	}
+	if sNode.Version != 4 {
+		t.Error("Unexpected version after update:", sNode.Version)
+	}
+	if len(lastBody) != 2 || lastBody["name"] != "renamed" {
+		t.Error("Expected only the name and version to be sent, but got:", lastBody)
+	}
+
+	_, err = host.ServiceUpdateVersion("s1", currentVersion-1, "renamed", "", nil, nil)
+	if !errors.Is(err, rest.ErrConflict) {
+		t.Error("Expected ErrConflict, but got:", err)
+	}
+}
+
+func TestHost_ServiceUpdate(t *testing.T) {
+	var lastBody map[string]interface{}
+	var ifMatch string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/apiv1/service/s1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		lastBody = nil
+		json.NewDecoder(r.Body).Decode(&lastBody)
+		ifMatch = r.Header.Get("If-Match")
+		w.Write([]byte(`{"id":"s1","name":"name","properties":{"a":"1"}}`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	sNode, err := host.ServiceUpdate("s1", "", "", map[string]string{"a": "1"}, nil)
+	if err != nil {
+		t.Fatal("Error updating service:", err)
+	}
+	if sNode.ID != "s1" || sNode.Properties["a"] != "1" {
+		t.Error("Unexpected updated service:", sNode)
+	}
+	// nil fields must not be sent, so the server keeps their values
+	if _, ok := lastBody["properties"]; !ok || len(lastBody) != 1 {
+		t.Error("Expected only the properties to be sent, but got:", lastBody)
+	}
+	if ifMatch != "" {
+		t.Error("Unversioned update was sent with a precondition:", ifMatch)
+	}
+}
+
+func TestLookupFold(t *testing.T) {
+	m := map[string]string{
+		"MQTTBroker": "tcp://exact:1883",
+		"mqttuser":   "user",
+		"MQTTUSER":   "USER",
+	}
+	if v, _ := rest.LookupFold(m, "MQTTBroker"); v != "tcp://exact:1883" {
+		t.Error("Unexpected value for exact key:", v)
+	}
+	if v, _ := rest.LookupFold(m, "MqttBroker"); v != "tcp://exact:1883" {
+		t.Error("Unexpected value for folded key:", v)
+	}
+	// the smallest matching key is used, for a stable result
+	if v, _ := rest.LookupFold(m, "MqttUser"); v != "USER" {
+		t.Error("Unexpected value for ambiguous key:", v)
+	}
+	if _, ok := rest.LookupFold(m, "MQTTPass"); ok {
+		t.Error("Expected no value for a missing key")
+	}
+}
+
+func TestServiceConfigParameter_ValidateValue(t *testing.T) {
+	tests := []struct {
+		param rest.ServiceConfigParameter
+		value string
+		valid bool
+	}{
+		{rest.ServiceConfigParameter{Name: "any"}, "text", true},
+		{rest.ServiceConfigParameter{Name: "optional", Type: rest.TypeInt}, "", true},
+		{rest.ServiceConfigParameter{Name: "required", Required: true}, "", false},
+		{rest.ServiceConfigParameter{Name: "count", Type: rest.TypeInt}, "-12", true},
+		{rest.ServiceConfigParameter{Name: "count", Type: rest.TypeInt}, "1.5", false},
+		{rest.ServiceConfigParameter{Name: "enabled", Type: rest.TypeBool}, "true", true},
+		{rest.ServiceConfigParameter{Name: "enabled", Type: rest.TypeBool}, "yes", false},
+		{rest.ServiceConfigParameter{Name: "mode", Type: rest.TypeEnum, Options: []string{"a", "b"}}, "b", true},
+		{rest.ServiceConfigParameter{Name: "mode", Type: rest.TypeEnum, Options: []string{"a", "b"}}, "c", false},
+		{rest.ServiceConfigParameter{Name: "future", Type: "color"}, "red", true},
+	}
+	for _, test := range tests {
+		err := test.param.ValidateValue(test.value)
+		if test.valid && err != nil {
+			t.Errorf("Expected %q to be valid for %s, but got: %v", test.value, test.param.Name, err)
+		}
+		if !test.valid && !errors.Is(err, rest.ErrInvalidConfigValue) {
+			t.Errorf("Expected ErrInvalidConfigValue for %q and %s, but got: %v", test.value, test.param.Name, err)
+		}
+	}
+}
+
+func TestHost_ServiceInfoCache(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"id":"s1","properties":{"a":"1"}}`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL, rest.WithServiceInfoCache(time.Minute, 10))
+	host.Login("id", "token")
+	for i := 0; i < 3; i++ {
+		if _, err := host.RequestServiceInfo("s1"); err != nil {
+			t.Fatal("Error requesting service info:", err)
+		}
+	}
+	if requests != 1 {
+		t.Error("Expected a single request, but got", requests)
+	}
+
+	// changing a returned node does not change the cached node
+	node, _ := host.RequestServiceInfo("s1")
+	node.Properties["changed"] = "yes"
+	if node, _ = host.RequestServiceInfo("s1"); node.Properties["changed"] != "" {
+		t.Error("Changing a returned node changed the cached node")
+	}
+
+	// entries are not shared with other users
+	other := host
+	other.Login("other", "token")
+	other.RequestServiceInfo("s1")
+	if requests != 2 {
+		t.Error("Expected a request for another user, but got", requests)
+	}
+
+	host.InvalidateServiceInfo("s1")
+	host.RequestServiceInfo("s1")
+	if requests != 3 {
+		t.Error("Expected a request after invalidation, but got", requests)
+	}
+}
+
+func TestHost_AuditService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apiv1/service/s1":
+			w.Write([]byte(`{"id":"s1","config_required":[
+				{"key_name":"rate","key_required":true,"key_type":"int"},
+				{"key_name":"label"}
+			]}`))
+		case "/apiv1/service/s1/things":
+			w.Write([]byte(`[
+				{"id":"good","config":[{"key":"rate","value":"10"}]},
+				{"id":"bad","config":[{"key":"rate","value":"fast"},{"key":"extra","value":"1"}]},
+				{"id":"missing","config":[]}
+			]`))
+		}
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	report, err := host.AuditService("s1")
+	if err != nil {
+		t.Fatal("Error auditing service:", err)
+	}
+	if report.Devices != 3 || len(report.Invalid) != 2 {
+		t.Fatal("Unexpected audit report:", report)
+	}
+	bad := report.Invalid[0]
+	if bad.DeviceID != "bad" || len(bad.Errors) != 2 ||
+		!errors.Is(bad.Errors[0], rest.ErrInvalidConfigValue) ||
+		!errors.Is(bad.Errors[1], rest.ErrUnknownConfigKey) {
+		t.Error("Unexpected audit of bad device:", bad.Errors)
+	}
+	if report.Invalid[1].DeviceID != "missing" {
+		t.Error("Expected the device missing a required key to be reported")
+	}
+}
+
+func TestServiceNode_CheckMQTTCredentials(t *testing.T) {
+	var node rest.ServiceNode
+	node.Properties = map[string]string{rest.PropertyMQTTUser: "user"}
+	if err := node.CheckMQTTCredentials(); !errors.Is(err, rest.ErrPartialCredentials) {
+		t.Error("Expected ErrPartialCredentials, but got:", err)
+	}
+	node.Properties[rest.PropertyMQTTBroker] = "tcp://broker:1883"
+	if err := node.ValidateMQTTProperties(); !errors.Is(err, rest.ErrPartialCredentials) {
+		t.Error("Expected ErrPartialCredentials, but got:", err)
+	}
+	node.Properties[rest.PropertyMQTTPass] = "pass"
+	if err := node.ValidateMQTTProperties(); err != nil {
+		t.Error("Unexpected error for full credentials:", err)
+	}
+	for _, broker := range []string{"ssl://broker:8883", "tls://broker:8883", "tcps://broker:8883", "wss://broker/mqtt"} {
+		node.Properties[rest.PropertyMQTTBroker] = broker
+		if err := node.ValidateMQTTProperties(); err != nil {
+			t.Errorf("Unexpected error for TLS broker %s: %v", broker, err)
+		}
+	}
+}
+
+func TestHost_ServiceCreateRefetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/apiv1/service":
+			w.Write([]byte(`{"id":"s1","name":"name"}`))
+		case r.Method == "GET" && r.URL.Path == "/apiv1/service/s1":
+			w.Write([]byte(`{"id":"s1","name":"name","pubsub":{"events_endpoint":"openchirp/service/s1/thing/events"}}`))
+		}
+	}))
+	defer server.Close()
+
+	sNode, err := rest.NewHost(server.URL).ServiceCreate("name", "", nil, nil)
+	if err != nil || sNode.Pubsub.TopicEvents != "" {
+		t.Error("Expected the partial create response, but got:", sNode, err)
+	}
+
+	sNode, err = rest.NewHost(server.URL, rest.WithCreateRefetch()).ServiceCreate("name", "", nil, nil)
+	if err != nil {
+		t.Fatal("Error creating service:", err)
+	}
+	if sNode.Pubsub.TopicEvents != "openchirp/service/s1/thing/events" {
+		t.Error("Expected the re-fetched service node, but got:", sNode)
+	}
+}
+
+func TestHost_RequestServiceDeviceListEmpty(t *testing.T) {
+	for _, body := range []string{`[]`, `null`, ``, " \n"} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+
+		devices, err := rest.NewHost(server.URL).RequestServiceDeviceList("s1")
+		if err != nil {
+			t.Errorf("Unexpected error for body %q: %v", body, err)
+		}
+		if devices == nil || len(devices) != 0 {
+			t.Errorf("Expected an empty non-nil slice for body %q, but got: %#v", body, devices)
+		}
+		server.Close()
+	}
+}
+
+func TestHost_ConfigParameterSchema(t *testing.T) {
+	var created map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			json.NewDecoder(r.Body).Decode(&created)
+		}
+		w.Write([]byte(`{"id":"s1","config_required":[{"name":"rate","mandatory":true,"key_example":"kept"}]}`))
+	}))
+	defer server.Close()
+
+	schema := rest.ConfigParameterSchema{Name: "name", Required: "mandatory"}
+	host := rest.NewHost(server.URL, rest.WithConfigParameterSchema(schema))
+
+	sNode, err := host.RequestServiceInfo("s1")
+	if err != nil {
+		t.Fatal("Error requesting service info:", err)
+	}
+	if len(sNode.ConfigParameters) != 1 {
+		t.Fatal("Unexpected config parameters:", sNode.ConfigParameters)
+	}
+	param := sNode.ConfigParameters[0]
+	if param.Name != "rate" || !param.Required || param.Example != "kept" {
+		t.Error("Unexpected mapped config parameter:", param)
+	}
+
+	params := []rest.ServiceConfigParameter{{Name: "rate", Required: true}}
+	if _, err := host.ServiceCreate("name", "", nil, params); err != nil {
+		t.Fatal("Error creating service:", err)
+	}
+	sent := created["config_required"].([]interface{})[0].(map[string]interface{})
+	if sent["name"] != "rate" || sent["mandatory"] != true || sent["key_name"] != nil {
+		t.Error("Unexpected sent config parameter:", sent)
+	}
+}
+
+func TestServiceNode_Clone(t *testing.T) {
+	var node rest.ServiceNode
+	node.Properties = map[string]string{"a": "1"}
+	node.ConfigParameters = []rest.ServiceConfigParameter{{Name: "mode", Options: []string{"x"}}}
+
+	clone := node.Clone()
+	clone.Properties["a"] = "2"
+	clone.ConfigParameters[0].Name = "changed"
+	clone.ConfigParameters[0].Options[0] = "y"
+
+	if node.Properties["a"] != "1" || node.ConfigParameters[0].Name != "mode" || node.ConfigParameters[0].Options[0] != "x" {
+		t.Error("Changing the clone changed the original:", node)
+	}
+}
+
+func TestHost_ServiceCreateWithResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Warning", `199 - "property \"x\" ignored" "Wed, 21 Oct 2015 07:28:00 GMT"`)
+		w.Write([]byte(`{"id":"s1","name":"name","warnings":["description truncated"]}`))
+	}))
+	defer server.Close()
+
+	result, err := rest.NewHost(server.URL).ServiceCreateWithResult("name", "", nil, nil)
+	if err != nil {
+		t.Fatal("Error creating service:", err)
+	}
+	if result.Node.ID != "s1" || result.Node.Name != "name" {
+		t.Error("Unexpected created node:", result.Node)
+	}
+	expected := []string{`property "x" ignored`, "description truncated"}
+	if len(result.Warnings) != len(expected) {
+		t.Fatal("Unexpected warnings:", result.Warnings)
+	}
+	for i := range expected {
+		if result.Warnings[i] != expected[i] {
+			t.Errorf("Unexpected warning %q, expected %q", result.Warnings[i], expected[i])
+		}
+	}
+}
+
+func TestHost_AcceptedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"id":"s1"}`))
+	}))
+	defer server.Close()
+
+	sNode, err := rest.NewHost(server.URL).ServiceCreate("name", "", nil, nil)
+	if err != nil || sNode.ID != "s1" {
+		t.Error("Expected 202 to be accepted by default, but got:", sNode, err)
+	}
+
+	host := rest.NewHost(server.URL, rest.WithAcceptedStatus(200))
+	if _, err := host.ServiceCreate("name", "", nil, nil); err == nil {
+		t.Error("Expected 202 to be an error when only 200 is accepted")
+	}
+}
+
+func TestHost_NoContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	if err := host.ServiceDelete("s1"); err != nil {
+		t.Error("Unexpected error for 204 on delete:", err)
+	}
+	if _, err := host.ServiceRename("s1", "name"); err != nil {
+		t.Error("Unexpected error for 204 on update:", err)
+	}
+}
+
+func TestHost_RequestServiceEvents(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apiv1/service/s1/events" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query = r.URL.RawQuery
+		w.Write([]byte(`[{"timestamp":"2017-06-01T12:00:00Z","level":"error","message":"failed"}]`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	since := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	events, err := host.RequestServiceEvents("s1", since, 10)
+	if err != nil {
+		t.Fatal("Error requesting service events:", err)
+	}
+	if query != "limit=10&since=2017-06-01T00%3A00%3A00Z" {
+		t.Error("Unexpected query:", query)
+	}
+	if len(events) != 1 || events[0].Level != "error" || !events[0].Timestamp.After(since) {
+		t.Error("Unexpected events:", events)
+	}
+}
+
+func TestPlanServiceMigration(t *testing.T) {
+	oldParams := []rest.ServiceConfigParameter{
+		{Name: "rate", Type: rest.TypeString},
+		{Name: "legacy"},
+	}
+	newParams := []rest.ServiceConfigParameter{
+		{Name: "rate", Type: rest.TypeInt},
+		{Name: "region", Required: true, Example: "us"},
+	}
+	devices := []rest.ServiceDeviceListItem{
+		{Id: "ok", Config: []rest.KeyValuePair{{Key: "rate", Value: "5"}, {Key: "region", Value: "eu"}}},
+		{Id: "old", Config: []rest.KeyValuePair{{Key: "rate", Value: "fast"}, {Key: "legacy", Value: "1"}}},
+	}
+
+	plan := rest.PlanServiceMigration(oldParams, newParams, devices)
+	if len(plan) != 1 || plan[0].DeviceID != "old" {
+		t.Fatal("Unexpected migration plan:", plan)
+	}
+	m := plan[0]
+	if len(m.Fill) != 1 || m.Fill[0].Name != "region" || m.Suggested["region"] != "us" {
+		t.Error("Unexpected keys to fill:", m.Fill, m.Suggested)
+	}
+	if len(m.Invalid) != 1 || !errors.Is(m.Invalid[0], rest.ErrInvalidConfigValue) {
+		t.Error("Unexpected invalid values:", m.Invalid)
+	}
+	if len(m.Obsolete) != 1 || m.Obsolete[0] != "legacy" {
+		t.Error("Unexpected obsolete keys:", m.Obsolete)
+	}
+}
+
+func TestHost_ServiceRename(t *testing.T) {
+	var lastBody map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastBody = nil
+		json.NewDecoder(r.Body).Decode(&lastBody)
+		w.Write([]byte(`{"id":"s1","name":"renamed"}`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	sNode, err := host.ServiceRename("s1", "renamed")
+	if err != nil {
+		t.Fatal("Error renaming service:", err)
+	}
+	if sNode.Name != "renamed" || len(lastBody) != 1 || lastBody["name"] != "renamed" {
+		t.Error("Expected only the name to be sent, but got:", lastBody)
+	}
+
+	if _, err := host.ServiceRename("s1", ""); err != rest.ErrEmptyServiceName {
+		t.Error("Expected ErrEmptyServiceName, but got:", err)
+	}
+}
+
+func TestHost_RequestServiceDeviceConfigsEffective(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apiv1/service/s1":
+			w.Write([]byte(`{"id":"s1","config_required":[
+				{"key_name":"rate","key_required":true,"key_type":"int","key_default":"60"},
+				{"key_name":"mode","key_required":true}
+			]}`))
+		case "/apiv1/service/s1/things":
+			w.Write([]byte(`[
+				{"id":"d1","config":[{"key":"rate","value":"10"},{"key":"mode","value":"fast"}]},
+				{"id":"d2","config":[]}
+			]`))
+		}
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	configs, err := host.RequestServiceDeviceConfigsEffective("s1")
+	if err != nil {
+		t.Fatal("Error requesting effective configs:", err)
+	}
+	if len(configs) != 2 {
+		t.Fatal("Unexpected effective configs:", configs)
+	}
+	if d1 := configs[0]; !d1.Valid() || d1.Config["rate"] != "10" || len(d1.Defaulted) != 0 {
+		t.Error("Unexpected effective config of d1:", d1)
+	}
+	d2 := configs[1]
+	if d2.Config["rate"] != "60" || len(d2.Defaulted) != 1 || d2.Defaulted[0] != "rate" {
+		t.Error("Expected the default rate for d2, but got:", d2)
+	}
+	if d2.Valid() || len(d2.Errors) != 1 {
+		t.Error("Expected only the missing mode to be reported for d2, but got:", d2.Errors)
+	}
+}
+
+func TestHost_RequestServiceListFiltered(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apiv1/service" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query = r.URL.Query()
+		if query.Get("limit") != "" {
+			w.Header().Set("X-Total-Count", "42")
+		}
+		w.Write([]byte(`[{"id":"s1"},{"id":"s2"}]`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	hasDevices := true
+	services, total, err := host.RequestServiceListFiltered(rest.ServiceListFilter{
+		Name:       "lora",
+		HasDevices: &hasDevices,
+		Offset:     10,
+		Limit:      2,
+	})
+	if err != nil {
+		t.Fatal("Error listing services:", err)
+	}
+	if len(services) != 2 || services[1].ID != "s2" || total != 42 {
+		t.Error("Unexpected service listing:", services, total)
+	}
+	expected := url.Values{"name": {"lora"}, "has_devices": {"true"}, "offset": {"10"}, "limit": {"2"}}
+	if query.Encode() != expected.Encode() {
+		t.Errorf("Expected query %q, but got %q", expected.Encode(), query.Encode())
+	}
+
+	services, err = host.RequestServiceList()
+	if err != nil || len(services) != 2 || len(query) != 0 {
+		t.Error("Unexpected unfiltered service listing:", services, query, err)
+	}
+}
+
+func TestHost_RequestServiceDeviceListPaged(t *testing.T) {
+	devices := []string{"d1", "d2", "d3", "d4", "d5"}
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			limit = 2 // server default
+		}
+		var page []rest.ServiceDeviceListItem
+		for i := offset; i < len(devices) && i < offset+limit; i++ {
+			page = append(page, rest.ServiceDeviceListItem{Id: devices[i]})
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(devices)))
+		json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	page, total, err := host.RequestServiceDeviceListPaged("s1", 1, 0)
+	if err != nil || total != 5 || len(page) != 2 || page[0].Id != "d2" {
+		t.Error("Unexpected page:", page, total, err)
+	}
+	if queries[0] != "offset=1" {
+		t.Error("A zero limit must be left to the server, but got query:", queries[0])
+	}
+
+	var streamed []string
+	items, errs := host.StreamServiceDeviceList(context.Background(), "s1", 0)
+	for item := range items {
+		streamed = append(streamed, item.Id)
+	}
+	if err := <-errs; err != nil {
+		t.Error("Unexpected stream error:", err)
+	}
+	if strings.Join(streamed, ",") != strings.Join(devices, ",") {
+		t.Error("Unexpected streamed devices:", streamed)
+	}
+}
+
+func TestHost_StreamServiceDeviceListUnpaged(t *testing.T) {
+	// the server ignores the paging query and always sends the full list
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"d1"},{"id":"d2"},{"id":"d3"}]`))
+	}))
+	defer server.Close()
+
+	host := rest.NewHost(server.URL)
+	for _, pageSize := range []int{0, 2, 3} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var streamed []string
+		items, errs := host.StreamServiceDeviceList(ctx, "s1", pageSize)
+		for item := range items {
+			streamed = append(streamed, item.Id)
+		}
+		if err := <-errs; err != nil {
+			t.Errorf("Unexpected stream error with page size %d: %v", pageSize, err)
+		}
+		if strings.Join(streamed, ",") != "d1,d2,d3" {
+			t.Errorf("Unexpected streamed devices with page size %d: %v", pageSize, streamed)
+		}
+		cancel()
+	}
+}
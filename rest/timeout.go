@@ -0,0 +1,89 @@
+package rest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Operation identifies a kind of request to the framework server, in order to
+// give it its own timeout with WithOperationTimeout
+type Operation string
+
+const (
+	OpRequestServiceInfo       Operation = "RequestServiceInfo"
+	OpRequestServiceList       Operation = "RequestServiceList"
+	OpRequestServiceDeviceList Operation = "RequestServiceDeviceList"
+	OpRequestServiceEvents     Operation = "RequestServiceEvents"
+	OpServiceCreate            Operation = "ServiceCreate"
+	OpServiceUpdate            Operation = "ServiceUpdate"
+	OpServiceDelete            Operation = "ServiceDelete"
+	OpRequestDeviceInfo        Operation = "RequestDeviceInfo"
+)
+
+// WithTimeout limits the time of every request, including reading the
+// response body. By default, requests have no time limit, so an unresponsive
+// framework server blocks the caller forever.
+// A request that exceeds the timeout fails with an error that wraps
+// context.DeadlineExceeded, which can be checked with errors.Is.
+// It can be overridden for single operations with WithOperationTimeout.
+func WithTimeout(timeout time.Duration) HostOption {
+	return func(host *Host) {
+		host.timeout = timeout
+	}
+}
+
+// WithOperationTimeout overrides the timeout set by WithTimeout for the given
+// operation, which allows giving a slow operation, like
+// RequestServiceDeviceList on a service with many devices, a generous timeout,
+// while keeping the other operations tight. A zero timeout means no limit.
+func WithOperationTimeout(op Operation, timeout time.Duration) HostOption {
+	return func(host *Host) {
+		if host.opTimeouts == nil {
+			host.opTimeouts = make(map[Operation]time.Duration)
+		}
+		host.opTimeouts[op] = timeout
+	}
+}
+
+// cancelOnClose cancels the request's context once the response body is
+// closed, which releases the request's timeout
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// doOp is like do, but applies the timeout of the operation op.
+// If the request's own context is done, its error is returned as is.
+func (host Host) doOp(op Operation, req *http.Request) (*http.Response, error) {
+	timeout := host.timeout
+	if d, ok := host.opTimeouts[op]; ok {
+		timeout = d
+	}
+	if timeout <= 0 {
+		resp, err := host.send(req)
+		if err != nil && req.Context().Err() != nil {
+			return resp, req.Context().Err()
+		}
+		return resp, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := host.send(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if req.Context().Err() != nil {
+			return resp, req.Context().Err()
+		}
+		return resp, err
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
@@ -43,16 +43,47 @@ func (n UserNode) String() string {
 // the User Node information for user authenticated.
 func (host Host) RequestUserInfo() (UserNode, error) {
 	var userNode UserNode
-	uri := host.uri + rootAPISubPath + userSubPath
+	uri := host.endpoint(rootAPISubPath, userSubPath)
 	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return userNode, err
+	}
 	req.SetBasicAuth(host.user, host.pass)
 
-	resp, err := host.client.Do(req)
+	resp, err := host.do(req)
 	if err != nil {
-		// should report auth problems here in future
 		return userNode, err
 	}
 	defer resp.Body.Close()
-	err = json.NewDecoder(resp.Body).Decode(&userNode)
+	if !host.statusOK(resp) {
+		return userNode, statusError(resp)
+	}
+	err = host.decodeResponse(resp, &userNode)
+	return userNode, err
+}
+
+// RequestUserInfoByID makes an HTTP GET to the framework server requesting
+// the User Node information for the user with ID userid, like the owner of a
+// service or device.
+// An *HTTPError matching ErrForbidden with errors.Is is returned if the
+// authenticated user is not permitted to view other users.
+func (host Host) RequestUserInfoByID(userid string) (UserNode, error) {
+	var userNode UserNode
+	uri := host.endpoint(rootAPISubPath, userSubPath, userid)
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return userNode, err
+	}
+	req.SetBasicAuth(host.user, host.pass)
+
+	resp, err := host.do(req)
+	if err != nil {
+		return userNode, err
+	}
+	defer resp.Body.Close()
+	if !host.statusOK(resp) {
+		return userNode, statusError(resp)
+	}
+	err = host.decodeResponse(resp, &userNode)
 	return userNode, err
 }
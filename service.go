@@ -1,18 +1,33 @@
 package framework
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"encoding/json"
 
+	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"github.com/openchirp/framework/rest"
 )
 
 const (
 	deviceUpdatesBuffering = 10
 	mqttPersistence        = false // we should never have this enabled
+	// serviceLogSubtopic is the service subtopic that log events are
+	// published to
+	serviceLogSubtopic = "log"
+	// serviceSchemaSubtopic is the service subtopic that config parameter
+	// schema changes are announced on
+	serviceSchemaSubtopic = "schema"
+	// tailBuffering is the number of tapped messages buffered for a slow
+	// Tail reader before messages are dropped
+	tailBuffering = 100
 )
 
 /* Options to be filled in by arguments */
@@ -23,9 +38,13 @@ var mqttQos uint
 
 var ErrMarshalStatusMessage = errors.New("Failed to marshall status message into JSON")
 var ErrMarshalDeviceStatusMessage = errors.New("Failed to marshall device status message into JSON")
+var ErrMarshalLogEvent = errors.New("Failed to marshall log event into JSON")
 var ErrNotImplemented = errors.New("This method is not implemented yet")
 var ErrDeviceUpdatesAlreadyStarted = errors.New("Device updates channel already started")
 var ErrDeviceUpdatesNotStarted = errors.New("Device updates channel not started")
+var ErrSnapshotAborted = errors.New("Device updates stopped before the snapshot was delivered")
+var ErrUnknownDeviceUpdateAction = errors.New("Unknown device update action")
+var ErrRequestTimeout = errors.New("Timed out waiting for a response")
 
 // DeviceUpdateType represents enumeration of DeviceUpdate types
 type DeviceUpdateType int
@@ -60,10 +79,21 @@ func (dut DeviceUpdateType) String() (s string) {
 
 // DeviceUpdate represents a pending service config change for a device
 type DeviceUpdate struct {
-	Type   DeviceUpdateType
-	Id     string
+	Type DeviceUpdateType
+	Id   string
+	// Name is the device's human readable name. It is only set when the
+	// framework server includes it in the update. Otherwise, it can be looked
+	// up using FetchDeviceInfo, at the cost of an additional REST request.
+	Name   string
 	Topic  string
 	Config map[string]string
+	// Bootstrap is true for updates that represent the initial state of a
+	// device, as fetched at start (see StartDeviceUpdatesSimple), and
+	// false for live changes received afterwards
+	Bootstrap bool
+	// ServiceID is the id of the service that the update was received for,
+	// which distinguishes updates merged by MergeDeviceUpdates
+	ServiceID string
 }
 
 func (du DeviceUpdate) Error() string {
@@ -75,21 +105,100 @@ func (du DeviceUpdate) Error() string {
 
 // String provides a human parsable string for DeviceUpdates
 func (du DeviceUpdate) String() string {
-	return fmt.Sprintf("Type: %v, Id: %s, Config: %v", du.Type, du.Id, du.Config)
+	return fmt.Sprintf("Type: %v, Id: %s, Name: %s, Config: %v", du.Type, du.Id, du.Name, du.Config)
 }
 
 // ServiceTopicHandler is a function prototype for a subscribed topic callback
 type ServiceTopicHandler func(client *ServiceClient, topic string, payload []byte)
 
+// ServiceTopicHandlerCtx is a function prototype for a subscribed topic
+// callback that also receives a context. The context is canceled when the
+// client is stopped and carries the received message's metadata, which can be
+// fetched with MessageIDFromContext.
+type ServiceTopicHandlerCtx func(ctx context.Context, client *ServiceClient, topic string, payload []byte)
+
+// DecodeErrorHandler is a function prototype for handling a received payload
+// that could not be decoded
+type DecodeErrorHandler func(topic string, payload []byte, err error)
+
+// messageIDKey is the context key for a received message's MQTT message id
+type messageIDKey struct{}
+
+// MessageIDFromContext returns the MQTT message id of the message that the
+// ServiceTopicHandlerCtx context was created for
+func MessageIDFromContext(ctx context.Context) (uint16, bool) {
+	id, ok := ctx.Value(messageIDKey{}).(uint16)
+	return id, ok
+}
+
 // ServiceClient hold a single ses.Publish(s.)rvice context
 type ServiceClient struct {
 	Client
-	node           rest.ServiceNode
-	updatesWg      sync.WaitGroup
+	node rest.ServiceNode
+	// nodeLock guards the parts of node that are updated while running,
+	// which are all but the id and pubsub endpoint. Maps of node are never
+	// modified in place, but replaced, so they can be read under the lock
+	// and then handed out as copies.
+	nodeLock sync.RWMutex
+
+	// updatesCtrl serializes starting and stopping device updates
+	updatesCtrl sync.Mutex
+	// updatesLock guards updatesRunning and is held for reading while an
+	// update is delivered from the MQTT callback
+	updatesLock    sync.RWMutex
 	updatesRunning bool
+	updatesStop    chan struct{}
 	updatesQueue   chan DeviceUpdate
+	updatesHandler func(DeviceUpdate)
+	updatesWorkers []chan DeviceUpdate
+	workersWg      sync.WaitGroup
+	snapshot       *deviceSnapshot
+	pumpDone       chan struct{}
 	updates        chan DeviceUpdate
 	manager        serviceRuntimeManager
+	// matchedLock guards matched, the devices that passed updatesFilter
+	matchedLock sync.Mutex
+	matched     map[string]bool
+	// probesLock guards probes, the nonces of undelivered ACL probes
+	probesLock sync.Mutex
+	probes     map[string]bool
+	// requestsLock guards requests, which serializes RequestDevice calls
+	// that share an ack topic. Entries only exist while requests use them.
+	requestsLock sync.Mutex
+	requests     map[string]*requestEntry
+	// tailsCtrl serializes subscribing and unsubscribing the subscription
+	// shared by all running Tails, and tailsLock guards tails, their channels
+	tailsCtrl sync.Mutex
+	tailsLock sync.RWMutex
+	tails     map[chan TappedMessage]struct{}
+	// heartbeatLock guards the stop and done channels of the heartbeat
+	heartbeatLock sync.Mutex
+	heartbeatStop chan struct{}
+	heartbeatDone chan struct{}
+	// propsCtrl serializes starting and stopping property updates, and
+	// propsLock guards propsRunning and is held for reading while a property
+	// update is delivered from the MQTT callback
+	propsCtrl    sync.Mutex
+	propsLock    sync.RWMutex
+	propsRunning bool
+	propsStop    chan struct{}
+	propsUpdates chan PropertyUpdate
+}
+
+// deviceSnapshot tracks the delivery of the initial configuration snapshot
+// for WaitForSnapshot
+type deviceSnapshot struct {
+	done chan struct{}
+	// err is only valid once done is closed
+	err error
+}
+
+// deliveredSnapshot returns a snapshot that is already delivered, for the
+// device updates modes that have no snapshot
+func deliveredSnapshot() *deviceSnapshot {
+	snapshot := &deviceSnapshot{done: make(chan struct{})}
+	close(snapshot.done)
+	return snapshot
 }
 
 type serviceRuntimeManager interface {
@@ -122,10 +231,56 @@ type serviceUpdatesEncapsulation struct {
 	Device rest.ServiceDeviceListItem `json:"thing"`
 }
 
+// ParseDeviceUpdate parses the raw MQTT payload of a device update event, as
+// received on the service's events topic, into a DeviceUpdate.
+// An ErrUnknownDeviceUpdateAction is returned if the event's action is not
+// one of "new", "update", or "delete".
+func ParseDeviceUpdate(payload []byte) (DeviceUpdate, error) {
+	var mqttMsg serviceUpdatesEncapsulation
+	if err := json.Unmarshal(payload, &mqttMsg); err != nil {
+		return DeviceUpdate{}, err
+	}
+
+	// action: new, update, delete
+	devUpdate := deviceUpdateFromListItem(mqttMsg.Device)
+	switch mqttMsg.Action {
+	case "new":
+		devUpdate.Type = DeviceUpdateTypeAdd
+	case "update":
+		devUpdate.Type = DeviceUpdateTypeUpd
+	case "delete":
+		devUpdate.Type = DeviceUpdateTypeRem
+	default:
+		return DeviceUpdate{}, fmt.Errorf("%w: %q", ErrUnknownDeviceUpdateAction, mqttMsg.Action)
+	}
+	return devUpdate, nil
+}
+
+// deviceUpdateFromListItem converts a device's service config into a
+// DeviceUpdate with DeviceUpdateTypeAdd as the type
+func deviceUpdateFromListItem(item rest.ServiceDeviceListItem) DeviceUpdate {
+	return DeviceUpdate{
+		Type:   DeviceUpdateTypeAdd,
+		Id:     item.Id,
+		Name:   item.Name,
+		Topic:  item.PubSub.Topic,
+		Config: item.GetConfigMap(),
+	}
+}
+
 type serviceStatus struct {
 	Message string `json:"message"`
 }
 
+// serviceLogEvent describes the JSON blob published by services as a
+// structured log event
+type serviceLogEvent struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Level     string            `json:"level"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
 type serviceDeviceStatus struct {
 	Device struct {
 		Id      string `json:"id"`
@@ -133,18 +288,122 @@ type serviceDeviceStatus struct {
 	} `json:"thing"`
 }
 
+// WithServiceInfoRetry retries the service info REST request made while
+// starting a service client up to attempts times in total, before giving up.
+// The delay between attempts starts at backoff and doubles after every
+// failed attempt. This is independent of any MQTT connection retries.
+// Only network errors and server errors (5xx) are retried, so that a bad
+// token or an unknown service id fails right away.
+//
+// This helps services start while the framework server is restarting,
+// like during a rolling deployment.
+func WithServiceInfoRetry(attempts int, backoff time.Duration) ClientOption {
+	return func(c *Client) {
+		c.serviceInfoAttempts = attempts
+		c.serviceInfoBackoff = backoff
+	}
+}
+
+// WithOfflineStatus makes StopClient publish statusmsg as a retained
+// service status right before disconnecting. This complements the status
+// message given to StartServiceClientStatus, which is only published by the
+// broker when the service disconnects improperly.
+func WithOfflineStatus(statusmsg string) ClientOption {
+	return func(c *Client) {
+		c.offlineStatus = statusmsg
+	}
+}
+
+// StalledUpdatesAction is what happens while the consumer of the device
+// updates channel is stalled, as detected by WithUpdatesWatchdog
+type StalledUpdatesAction int
+
+const (
+	// StalledUpdatesWarn only logs a warning and keeps waiting for the
+	// consumer, which eventually blocks the MQTT client
+	StalledUpdatesWarn StalledUpdatesAction = iota
+	// StalledUpdatesDrop logs a warning and drops device updates until the
+	// consumer reads again, which keeps the MQTT client running
+	StalledUpdatesDrop
+)
+
+// WithUpdatesWatchdog detects a stalled consumer of the channel returned by
+// StartDeviceUpdates or StartDeviceUpdatesSimple, which has not read a
+// pending update for timeout. This is usually a consumer that stopped reading
+// without calling StopDeviceUpdates, which would otherwise block the MQTT
+// client's callbacks and silently wedge the service.
+// A stall is always logged and handled as set by action. The optional onStall
+// callback is also called, once per stall, from the goroutine that feeds the
+// channel.
+func WithUpdatesWatchdog(timeout time.Duration, action StalledUpdatesAction, onStall func()) ClientOption {
+	return func(c *Client) {
+		c.updatesWatchdog = timeout
+		c.updatesStalledAction = action
+		c.updatesOnStall = onStall
+	}
+}
+
+// WithDeviceUpdatesFilter only delivers the device updates of devices whose
+// config matches predicate, for services that only handle a subset of a large
+// device population. The filter applies to all ways of receiving device
+// updates, including the initial configurations of StartDeviceUpdatesSimple.
+//
+// A device that stops matching, because its config was updated, is delivered
+// as a DeviceUpdateTypeRem update, so that the consumer can drop it. Removals
+// are only delivered for devices that matched before. Likewise, a device that
+// starts matching is delivered as a DeviceUpdateTypeAdd update.
+func WithDeviceUpdatesFilter(predicate func(config map[string]string) bool) ClientOption {
+	return func(c *Client) {
+		c.updatesFilter = predicate
+	}
+}
+
+// WithCaseInsensitiveKeys makes GetProperty ignore the case of the service's
+// property keys, since operators do not always enter them with consistent
+// casing. Device config values can be looked up the same way with
+// rest.LookupFold.
+func WithCaseInsensitiveKeys() ClientOption {
+	return func(c *Client) {
+		c.foldKeys = true
+	}
+}
+
+// requestServiceInfo fetches the service's node, retrying network and server
+// errors as configured by WithServiceInfoRetry
+func (c *ServiceClient) requestServiceInfo() (rest.ServiceNode, error) {
+	delay := c.serviceInfoBackoff
+	for attempt := 1; ; attempt++ {
+		node, err := c.host.RequestServiceInfo(c.id)
+		if err == nil || attempt >= c.serviceInfoAttempts {
+			return node, err
+		}
+		var httpErr *rest.HTTPError
+		if errors.As(err, &httpErr) && httpErr.StatusCode < 500 {
+			return node, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 // StartServiceClient starts the service management layer
-func StartServiceClient(frameworkuri, brokeruri, id, token string) (*ServiceClient, error) {
-	c, err := StartServiceClientStatus(frameworkuri, brokeruri, id, token, "")
+func StartServiceClient(frameworkuri, brokeruri, id, token string, opts ...ClientOption) (*ServiceClient, error) {
+	c, err := StartServiceClientStatus(frameworkuri, brokeruri, id, token, "", opts...)
 	return c, err
 }
 
 // StartServiceClientStatus starts the service management layer with a optional
-// statusmsg if the service disconnects improperly
-func StartServiceClientStatus(frameworkuri, brokeruri, id, token, statusmsg string) (*ServiceClient, error) {
+// statusmsg if the service disconnects improperly.
+// The optional MQTTQos service property sets the default QoS of the service's
+// subscriptions and publishes, which is otherwise 0.
+// If brokeruri is empty, the broker is discovered from the WithBroker option,
+// the service's MQTT properties, or the framework server's broker config,
+// in that order. ErrNoBroker is returned if all of them fail.
+func StartServiceClientStatus(frameworkuri, brokeruri, id, token, statusmsg string, opts ...ClientOption) (*ServiceClient, error) {
 	var err error
 
 	c := new(ServiceClient)
+	c.applyOptions(opts)
 
 	// Start enough of the client manually to get REST working
 	c.setAuth(id, token)
@@ -154,10 +413,13 @@ func StartServiceClientStatus(frameworkuri, brokeruri, id, token, statusmsg stri
 	}
 
 	// Get Our Service Info
-	c.node, err = c.host.RequestServiceInfo(c.id)
+	c.node, err = c.requestServiceInfo()
 	if err != nil {
 		return nil, err
 	}
+	if err := c.node.Pubsub.Validate(); err != nil {
+		return nil, err
+	}
 
 	// Setup will'ed status
 	if statusmsg != "" {
@@ -170,7 +432,22 @@ func StartServiceClientStatus(frameworkuri, brokeruri, id, token, statusmsg stri
 		c.setWill(c.node.Pubsub.TopicStatus, []byte(payload))
 	}
 
+	// Apply the service's configured QoS
+	if qos := c.node.Properties[rest.PropertyMQTTQos]; qos != "" {
+		c.qos, err = parseQoS(qos)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Start MQTT
+	if brokeruri == "" && !c.brokerFixed {
+		c.brokerRefresh = c.refreshServiceBroker
+	}
+	err = c.discoverBroker(brokeruri)
+	if err != nil {
+		return nil, err
+	}
 	err = c.startMQTT(brokeruri)
 	if err != nil {
 		return nil, err
@@ -179,12 +456,81 @@ func StartServiceClientStatus(frameworkuri, brokeruri, id, token, statusmsg stri
 	return c, nil
 }
 
-// StopClient shuts down a started service
+// parseQoS parses an MQTT QoS level of 0, 1, or 2
+func parseQoS(s string) (byte, error) {
+	qos, err := strconv.ParseUint(strings.TrimSpace(s), 10, 8)
+	if err != nil || qos > 2 {
+		return 0, fmt.Errorf("Invalid %s property %q, it must be 0, 1, or 2", rest.PropertyMQTTQos, s)
+	}
+	return byte(qos), nil
+}
+
+// discoverBroker uses the service's MQTT properties as the broker, unless the
+// broker was explicitly given as brokeruri or with WithBroker.
+// The broker is discovered in the following order, by the first that is set:
+//  1. The brokeruri argument
+//  2. The WithBroker option
+//  3. The service's MQTTBroker, MQTTUser, and MQTTPass properties
+//  4. The framework server's broker config
+//
+// The last one is only requested by startMQTT, if needed.
+// Only one of the MQTTUser and MQTTPass properties being set is always an
+// ErrPartialCredentials error, rather than connecting anonymously.
+func (c *ServiceClient) discoverBroker(brokeruri string) error {
+	c.mqttLock.RLock()
+	configured := c.brokerConfig != nil
+	c.mqttLock.RUnlock()
+	if brokeruri != "" || configured {
+		return nil
+	}
+	c.nodeLock.RLock()
+	config, err := serviceBrokerConfig(c.node)
+	c.nodeLock.RUnlock()
+	if err != nil || config == nil {
+		return err
+	}
+	c.mqttLock.Lock()
+	c.brokerConfig = config
+	c.mqttLock.Unlock()
+	return nil
+}
+
+// NewServiceClientWith builds a service client around an existing node,
+// MQTT client, and REST host, without fetching the service info or
+// connecting to the broker. This is intended for tests and for advanced uses
+// where the MQTT connection lifecycle is managed outside of this package.
+// The MQTT client should already be connected. Since its options are not
+// under our control, subscriptions are not restored after a reconnect and
+// ConnectionStats are not tracked.
+func NewServiceClientWith(node rest.ServiceNode, client MQTT.Client, host rest.Host, opts ...ClientOption) *ServiceClient {
+	c := new(ServiceClient)
+	c.applyOptions(opts)
+	c.id = node.ID
+	c.node = node
+	c.host = host
+	c.mqtt = client
+	return c
+}
+
+// StopClient shuts down a started service, without waiting for pending
+// publishes. Use StopClientGraceful or Close to flush them.
+// It is safe to call on a nil or partially started client, so that it can
+// always be deferred after StartServiceClient, and calling it again does
+// nothing.
 func (c *ServiceClient) StopClient() {
-	if c.manager != nil {
-		c.manager.Stop()
+	c.stop(false, 0, 0)
+}
+
+// publishOfflineStatus publishes the status set by WithOfflineStatus as the
+// retained service status
+func (c *ServiceClient) publishOfflineStatus() error {
+	var msg serviceStatus
+	msg.Message = c.offlineStatus
+	payload, err := json.Marshal(&msg)
+	if err != nil {
+		return ErrMarshalStatusMessage
 	}
-	c.stopClient()
+	return c.publishRetained(c.node.Pubsub.TopicStatus, payload)
 }
 
 // SetStatus publishes the service status message
@@ -210,77 +556,281 @@ func (c *ServiceClient) SetDeviceStatus(id string, msgs ...interface{}) error {
 	return c.Publish(c.node.Pubsub.TopicStatus, payload)
 }
 
+// LogEvent publishes a structured operational event, like an error or warning,
+// to the service's log topic (<service topic>/log). The fields map can be nil.
+// The event is published as the following JSON object:
+//
+//	{
+//		"timestamp": "2017-06-01T12:00:00Z",
+//		"level": "<level>",
+//		"message": "<message>",
+//		"fields": {"<key>": "<value>"}
+//	}
+func (c *ServiceClient) LogEvent(level, message string, fields map[string]string) error {
+	event := serviceLogEvent{
+		Timestamp: time.Now().UTC(),
+		Level:     level,
+		Message:   message,
+		Fields:    fields,
+	}
+	payload, err := json.Marshal(&event)
+	if err != nil {
+		return ErrMarshalLogEvent
+	}
+	return c.Publish(TopicJoin(c.node.Pubsub.Topic, serviceLogSubtopic), payload)
+}
+
 func (c *ServiceClient) updateEventsHandler() func(topic string, payload []byte) {
 	return func(topic string, payload []byte) {
-		c.updatesWg.Add(1)
-		defer c.updatesWg.Done()
-		if c.updatesRunning {
-			// action: new, update, delete
-			var mqttMsg serviceUpdatesEncapsulation
-			var devUpdate DeviceUpdate
-
-			err := json.Unmarshal(payload, &mqttMsg)
-			if err != nil {
-				c.updatesQueue <- DeviceUpdate{
-					Type: DeviceUpdateTypeErr,
-					Id:   fmt.Sprintf("Failed to unmarshal message on topic %s\n", topic),
-				}
-				return
-			}
+		// The read lock is held for the whole delivery, so that
+		// stopDeviceUpdatesDelivery can wait for deliveries in progress
+		c.updatesLock.RLock()
+		defer c.updatesLock.RUnlock()
+		if !c.updatesRunning {
+			return
+		}
 
-			switch mqttMsg.Action {
-			case "new":
-				devUpdate.Type = DeviceUpdateTypeAdd
-			case "update":
-				devUpdate.Type = DeviceUpdateTypeUpd
-			case "delete":
-				devUpdate.Type = DeviceUpdateTypeRem
+		devUpdate, err := ParseDeviceUpdate(payload)
+		if errors.Is(err, ErrUnknownDeviceUpdateAction) && c.isOwnACLProbe(payload) {
+			return
+		}
+		if err != nil {
+			devUpdate = DeviceUpdate{
+				Type: DeviceUpdateTypeErr,
+				Id:   fmt.Sprintf("Failed to parse message on topic %s: %v\n", topic, err),
 			}
-			devUpdate.Id = mqttMsg.Device.Id
-			devUpdate.Topic = mqttMsg.Device.PubSub.Topic
-			devUpdate.Config = mqttMsg.Device.GetConfigMap()
+		}
 
-			c.updatesQueue <- devUpdate
+		devUpdate.ServiceID = c.node.ID
+		devUpdate, ok := c.filterDeviceUpdate(devUpdate)
+		if !ok {
+			return
+		}
+
+		if c.updatesHandler != nil {
+			c.updatesHandler(devUpdate)
+			return
+		}
+		select {
+		case c.updatesQueue <- devUpdate:
+		case <-c.updatesStop:
+			// updates are being stopped, so discard instead of blocking
 		}
 	}
 }
 
-func (c *ServiceClient) startDeviceUpdatesQueue() error {
-	/* Setup MQTT based device updates to feed updatesQueue */
-	topicEvents := c.node.Pubsub.TopicEvents
+// filterDeviceUpdate applies the filter set by WithDeviceUpdatesFilter to
+// update. It returns false if the update should not be delivered. An update
+// that makes a matching device stop matching is turned into a removal, and
+// one that makes a device start matching is turned into an addition.
+func (c *ServiceClient) filterDeviceUpdate(update DeviceUpdate) (DeviceUpdate, bool) {
+	if c.updatesFilter == nil || update.Type == DeviceUpdateTypeErr {
+		return update, true
+	}
+	c.matchedLock.Lock()
+	defer c.matchedLock.Unlock()
+	if update.Type != DeviceUpdateTypeRem && c.updatesFilter(update.Config) {
+		if update.Type == DeviceUpdateTypeUpd && !c.matched[update.Id] {
+			// the consumer has never seen this device
+			update.Type = DeviceUpdateTypeAdd
+		}
+		c.matched[update.Id] = true
+		return update, true
+	}
+	if !c.matched[update.Id] {
+		return update, false
+	}
+	delete(c.matched, update.Id)
+	update.Type = DeviceUpdateTypeRem
+	return update, true
+}
+
+// filterDeviceUpdates applies filterDeviceUpdate to every update
+func (c *ServiceClient) filterDeviceUpdates(updates []DeviceUpdate) []DeviceUpdate {
+	if c.updatesFilter == nil {
+		return updates
+	}
+	filtered := updates[:0]
+	for _, update := range updates {
+		if update, ok := c.filterDeviceUpdate(update); ok {
+			filtered = append(filtered, update)
+		}
+	}
+	return filtered
+}
+
+// startDeviceUpdatesDelivery marks device updates as running and subscribes
+// to the device updates topics. The caller must hold updatesCtrl.
+// If ctx is done before the subscribe completes, everything is rolled back
+// and ctx's error is returned.
+func (c *ServiceClient) startDeviceUpdatesDelivery(ctx context.Context, handler func(DeviceUpdate)) error {
+	c.updatesLock.Lock()
 	if c.updatesRunning {
+		c.updatesLock.Unlock()
 		return ErrDeviceUpdatesAlreadyStarted
 	}
 	c.updatesRunning = true
-	c.updatesQueue = make(chan DeviceUpdate, deviceUpdatesBuffering)
-	err := c.Subscribe(topicEvents, c.updateEventsHandler())
-	if err != nil {
-		c.stopDeviceUpdatesQueue()
-		return err
+	c.updatesStop = make(chan struct{})
+	c.matchedLock.Lock()
+	c.matched = make(map[string]bool)
+	c.matchedLock.Unlock()
+	c.updatesHandler = handler
+	if handler == nil {
+		c.updatesQueue = make(chan DeviceUpdate, deviceUpdatesBuffering)
+	}
+	c.updatesLock.Unlock()
+
+	callback := c.updateEventsHandler()
+	for _, topic := range c.deviceUpdatesTopics() {
+		err := c.subscribeMessageCtx(ctx, topic, c.deviceUpdatesQoS, func(message MQTT.Message) {
+			callback(message.Topic(), message.Payload())
+		})
+		if err != nil {
+			c.abortDeviceUpdatesDelivery(ctx)
+			return err
+		}
+	}
+	if handler != nil {
+		// handlers never receive a snapshot
+		c.snapshot = deliveredSnapshot()
 	}
 	return nil
 }
 
-func (c *ServiceClient) stopDeviceUpdatesQueue() error {
-	topicEvents := c.node.Pubsub.TopicEvents
-	if c.updatesRunning {
-		return ErrDeviceUpdatesNotStarted
+// deviceUpdatesTopics returns the topics that device updates are subscribed
+// to, which are also the topics checked by ProbeDeviceUpdatesACL
+func (c *ServiceClient) deviceUpdatesTopics() []string {
+	return []string{c.node.Pubsub.TopicEvents}
+}
+
+// stopDeviceUpdatesDelivery stops and waits for all device update deliveries
+// from the MQTT callback. The caller must hold updatesCtrl.
+// It returns false if device updates were not running.
+//
+// The order is important to never deadlock with a callback that is blocked on
+// a full queue. The blocked callback occupies the MQTT client's dispatcher,
+// which may be needed to complete the unsubscribe, so the callbacks are
+// released first, then unsubscribed, and then waited for.
+func (c *ServiceClient) stopDeviceUpdatesDelivery() bool {
+	return c.abortDeviceUpdatesDelivery(context.Background())
+}
+
+// abortDeviceUpdatesDelivery is like stopDeviceUpdatesDelivery, but does not
+// wait for the unsubscribe to complete once ctx is done, so that rolling back
+// a canceled start does not wait on a slow broker either
+func (c *ServiceClient) abortDeviceUpdatesDelivery(ctx context.Context) bool {
+	c.updatesLock.RLock()
+	running := c.updatesRunning
+	c.updatesLock.RUnlock()
+	if !running {
+		return false
 	}
 
-	c.Unsubscribe(topicEvents)
+	close(c.updatesStop)
+	c.unsubscribeCtx(ctx, c.deviceUpdatesTopics()...)
+
+	// wait for all running deliveries to finish
+	c.updatesLock.Lock()
 	c.updatesRunning = false
+	c.updatesHandler = nil
+	c.updatesLock.Unlock()
+	// a snapshot that is still being delivered is aborted by the pump
+	c.snapshot = nil
+
+	if c.updatesQueue != nil {
+		// there can be no more senders, so this releases the pump
+		close(c.updatesQueue)
+		c.updatesQueue = nil
+	}
+	return true
+}
+
+// startDeviceUpdatesPump opens the updates channel and starts the goroutine
+// that forwards the preload updates and then the queued live updates to it.
+// Once updates are stopped, the pump discards whatever the consumer did not
+// read and closes the updates channel.
+func (c *ServiceClient) startDeviceUpdatesPump(preload []DeviceUpdate) <-chan DeviceUpdate {
+	updates := make(chan DeviceUpdate)
+	snapshot := &deviceSnapshot{done: make(chan struct{})}
+	pumpDone := make(chan struct{})
+	queue, stop := c.updatesQueue, c.updatesStop
+	c.updates = updates
+	c.snapshot = snapshot
+	c.pumpDone = pumpDone
 
-	// Unblock all possible updateEventsHandlers while we wait
 	go func() {
-		for _ = range c.updatesQueue {
-			// read all remaining elements in order to close chan and go routines
+		defer close(pumpDone)
+		defer close(updates)
+		stalled := false
+
+		// the initial configuration is always delivered first
+		for _, update := range preload {
+			if !c.pumpSend(updates, update, stop, &stalled) {
+				// release the waiters of WaitForSnapshot
+				snapshot.err = ErrSnapshotAborted
+				close(snapshot.done)
+				return
+			}
+		}
+		close(snapshot.done)
+
+		for update := range queue {
+			if !c.pumpSend(updates, update, stop, &stalled) {
+				// discard until the queue is closed
+				for range queue {
+				}
+				return
+			}
 		}
-		c.updatesQueue = nil
 	}()
-	// wait for all activivley running routines to finish writing to channel
-	c.updatesWg.Wait()
-	close(c.updatesQueue)
-	return nil
+
+	return updates
+}
+
+// pumpSend sends update to the consumer of the updates channel, while
+// watching for a stalled consumer, as configured by WithUpdatesWatchdog.
+// The stalled state is kept by the caller across sends. It returns false if
+// device updates are being stopped.
+func (c *ServiceClient) pumpSend(updates chan<- DeviceUpdate, update DeviceUpdate, stop <-chan struct{}, stalled *bool) bool {
+	if *stalled && c.updatesStalledAction == StalledUpdatesDrop {
+		select {
+		case updates <- update:
+			*stalled = false
+		case <-stop:
+			return false
+		default:
+			// the consumer is still stalled, so drop the update
+		}
+		return true
+	}
+
+	var timeout <-chan time.Time
+	if c.updatesWatchdog > 0 && !*stalled {
+		timer := time.NewTimer(c.updatesWatchdog)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case updates <- update:
+			*stalled = false
+			return true
+		case <-stop:
+			return false
+		case <-timeout:
+			timeout = nil
+			*stalled = true
+			c.logf("WARNING: Device updates have not been read for %v, "+
+				"the consumer of the device updates channel may be stuck or "+
+				"StopDeviceUpdates was not called", c.updatesWatchdog)
+			if c.updatesOnStall != nil {
+				c.updatesOnStall()
+			}
+			if c.updatesStalledAction == StalledUpdatesDrop {
+				return true
+			}
+		}
+	}
 }
 
 // StartDeviceUpdatesSimple subscribes to the live mqtt service news topic and opens
@@ -290,9 +840,20 @@ func (c *ServiceClient) stopDeviceUpdatesQueue() error {
 // configuration, there may be redundant DeviceUpdateTypeAdd updates. Your
 // program should account for this.
 func (c *ServiceClient) StartDeviceUpdatesSimple() (<-chan DeviceUpdate, error) {
+	return c.StartDeviceUpdatesSimpleCtx(c.ctx)
+}
+
+// StartDeviceUpdatesSimpleCtx is like StartDeviceUpdatesSimple, but gives up
+// starting once ctx is done. The subscribe is abandoned and rolled back, and
+// ctx's error is returned, so that a shutdown during startup is not delayed
+// by a slow broker. StartDeviceUpdatesSimple uses the client's lifetime as ctx.
+// The ctx only applies to starting, use StopDeviceUpdates to stop the updates.
+func (c *ServiceClient) StartDeviceUpdatesSimpleCtx(ctx context.Context) (<-chan DeviceUpdate, error) {
+	c.updatesCtrl.Lock()
+	defer c.updatesCtrl.Unlock()
 
 	/* Setup MQTT based device updates to feed updatesQueue */
-	err := c.startDeviceUpdatesQueue()
+	err := c.startDeviceUpdatesDelivery(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -300,58 +861,219 @@ func (c *ServiceClient) StartDeviceUpdatesSimple() (<-chan DeviceUpdate, error)
 	/* Preload device updates from REST request */
 	configUpdates, err := c.FetchDeviceConfigsAsUpdates()
 	if err != nil {
-		c.stopDeviceUpdatesQueue()
+		c.stopDeviceUpdatesDelivery()
 		return nil, err
 	}
-	c.updates = make(chan DeviceUpdate, len(configUpdates))
-	for _, update := range configUpdates {
-		c.updates <- update
+	if err := ctx.Err(); err != nil {
+		c.abortDeviceUpdatesDelivery(ctx)
+		return nil, err
 	}
+	configUpdates = c.filterDeviceUpdates(configUpdates)
 
 	/* Connect updatesQueue channel to updates channel */
+	return c.startDeviceUpdatesPump(configUpdates), nil
+}
+
+// RunDeviceUpdates starts device updates like StartDeviceUpdatesSimple and
+// calls handler for every update from a single managed goroutine, in the order
+// received. This formalizes the update loop's goroutine lifecycle.
+//
+// The returned stop function stops the device updates, like
+// StopDeviceUpdates, and may be called more than once, including from within
+// handler. The done channel is closed once the goroutine has returned from its
+// last handler call and exited. If wg is not nil, it is also incremented for
+// the goroutine and decremented once it exits, so that a shutdown can simply
+// wait on wg.
+func (c *ServiceClient) RunDeviceUpdates(wg *sync.WaitGroup, handler func(DeviceUpdate)) (stop func(), done <-chan struct{}, err error) {
+	updates, err := c.StartDeviceUpdatesSimple()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pumpDone := make(chan struct{})
+	if wg != nil {
+		wg.Add(1)
+	}
 	go func() {
-		for update := range c.updatesQueue {
-			c.updates <- update
+		if wg != nil {
+			defer wg.Done()
+		}
+		defer close(pumpDone)
+		for update := range updates {
+			handler(update)
 		}
-		close(c.updates)
 	}()
 
-	return c.updates, err
+	var once sync.Once
+	stop = func() {
+		// StopDeviceUpdates does not wait for the consumer of the channel,
+		// so this is safe to call from handler
+		once.Do(c.StopDeviceUpdates)
+	}
+	return stop, pumpDone, nil
+}
+
+// WaitForSnapshot blocks until the consumer of the StartDeviceUpdatesSimple
+// channel has received every update of the initial configuration snapshot,
+// or until ctx is done. This allows a service to only report itself as ready
+// once it has seen all pre-existing devices.
+// For the other device updates modes, which have no snapshot, it returns
+// immediately while they are running.
+// ErrDeviceUpdatesNotStarted is returned if device updates are not running,
+// and ErrSnapshotAborted if they are stopped before the snapshot was
+// received.
+func (c *ServiceClient) WaitForSnapshot(ctx context.Context) error {
+	c.updatesCtrl.Lock()
+	snapshot := c.snapshot
+	c.updatesCtrl.Unlock()
+	if snapshot == nil {
+		return ErrDeviceUpdatesNotStarted
+	}
+	select {
+	case <-snapshot.done:
+		return snapshot.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // StartDeviceUpdates subscribes to the live service events topic and opens
 // a channel to read the updates from. This does not inject the initial
 // configurations into the channel at start like StartDeviceUpdatesSimple.
 func (c *ServiceClient) StartDeviceUpdates() (<-chan DeviceUpdate, error) {
+	return c.StartDeviceUpdatesCtx(c.ctx)
+}
+
+// StartDeviceUpdatesCtx is like StartDeviceUpdates, but gives up starting
+// once ctx is done, like StartDeviceUpdatesSimpleCtx.
+func (c *ServiceClient) StartDeviceUpdatesCtx(ctx context.Context) (<-chan DeviceUpdate, error) {
+	c.updatesCtrl.Lock()
+	defer c.updatesCtrl.Unlock()
 
 	/* Setup MQTT based device updates to feed updatesQueue */
-	err := c.startDeviceUpdatesQueue()
+	err := c.startDeviceUpdatesDelivery(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	/* Make the updates channel */
-	c.updates = make(chan DeviceUpdate)
-
 	/* Connect updatesQueue channel to updates channel */
-	go func() {
-		for update := range c.updatesQueue {
-			c.updates <- update
+	return c.startDeviceUpdatesPump(nil), nil
+}
+
+// StartDeviceUpdatesHandler subscribes to the live service events topic and
+// invokes handler for every device update, without an intermediate channel.
+// Like StartDeviceUpdates, the initial configurations are not injected.
+//
+// The handler is called synchronously from the MQTT client's message callback,
+// one update at a time and in the order received. While the handler runs,
+// no other MQTT messages are dispatched for this client, so a slow handler
+// directly applies back-pressure to the broker connection.
+// The handler must not block on other MQTT operations of this client,
+// like Subscribe, Unsubscribe, or Publish, since the acknowledgements for
+// these may never be processed. For the same reason, the handler must not
+// call StopDeviceUpdates or StopClient.
+//
+// Use StopDeviceUpdates to stop receiving updates. It returns after all
+// running handler calls have finished.
+func (c *ServiceClient) StartDeviceUpdatesHandler(handler func(DeviceUpdate)) error {
+	c.updatesCtrl.Lock()
+	defer c.updatesCtrl.Unlock()
+	return c.startDeviceUpdatesDelivery(c.ctx, handler)
+}
+
+// StartDeviceUpdatesWorkers subscribes to the live service events topic and
+// dispatches device updates to a pool of worker goroutines, which call
+// handler. All updates for the same device are always handled by the same
+// worker, so that they are handled in the order received, while updates for
+// different devices are handled in parallel.
+// Like StartDeviceUpdates, the initial configurations are not injected.
+//
+// Use StopDeviceUpdates to stop receiving updates. It returns after all
+// workers have handled their pending updates and exited.
+func (c *ServiceClient) StartDeviceUpdatesWorkers(workers int, handler func(DeviceUpdate)) error {
+	c.updatesCtrl.Lock()
+	defer c.updatesCtrl.Unlock()
+
+	if workers < 1 {
+		workers = 1
+	}
+	if c.updatesWorkers != nil {
+		return ErrDeviceUpdatesAlreadyStarted
+	}
+
+	queues := make([]chan DeviceUpdate, workers)
+	for i := range queues {
+		queue := make(chan DeviceUpdate, deviceUpdatesBuffering)
+		queues[i] = queue
+		c.workersWg.Add(1)
+		go func() {
+			defer c.workersWg.Done()
+			for update := range queue {
+				handler(update)
+			}
+		}()
+	}
+	c.updatesWorkers = queues
+
+	err := c.startDeviceUpdatesDelivery(c.ctx, func(update DeviceUpdate) {
+		// consistently hash the device id to a worker
+		h := fnv.New32a()
+		h.Write([]byte(update.Id))
+		select {
+		case queues[h.Sum32()%uint32(len(queues))] <- update:
+		case <-c.updatesStop:
+			// updates are being stopped, so discard instead of blocking
 		}
-		close(c.updates)
-	}()
+	})
+	if err != nil {
+		c.stopDeviceUpdatesWorkers()
+		return err
+	}
+	return nil
+}
 
-	return c.updates, err
+// stopDeviceUpdatesWorkers closes the worker queues and waits for the workers
+// to handle their pending updates
+func (c *ServiceClient) stopDeviceUpdatesWorkers() {
+	for _, queue := range c.updatesWorkers {
+		close(queue)
+	}
+	c.workersWg.Wait()
+	c.updatesWorkers = nil
 }
 
 // StopDeviceUpdates unsubscribes from service news topic and closes the
-// news channel
+// news channel.
+//
+// Shutdown happens in the following order, so that it never deadlocks with
+// or panics in an MQTT callback that is delivering an update:
+//  1. Deliveries that are blocked on a full channel are released and
+//     further updates are discarded.
+//  2. The service news topic is unsubscribed.
+//  3. Deliveries in progress, including handler calls, are waited for.
+//  4. Pending updates that the consumer did not read are discarded and the
+//     channel is closed. Workers are allowed to handle their pending updates.
+//
+// It is safe to call on a nil client, when updates are not running, like
+// after a failed start, repeatedly, and concurrently with StopClient.
+// The consumer of the updates channel does not need to keep reading for
+// StopDeviceUpdates to return.
 func (c *ServiceClient) StopDeviceUpdates() {
-	topicEvents := c.node.Pubsub.TopicEvents
-	c.Unsubscribe(topicEvents)
-	close(c.updatesQueue)
-	for _ = range c.updates {
-		// read all remaining elements in order to close chan and go routine
+	if c == nil {
+		return
+	}
+	c.updatesCtrl.Lock()
+	defer c.updatesCtrl.Unlock()
+
+	if !c.stopDeviceUpdatesDelivery() {
+		return
+	}
+	if c.pumpDone != nil {
+		<-c.pumpDone
+		c.pumpDone = nil
+	}
+	if c.updatesWorkers != nil {
+		c.stopDeviceUpdatesWorkers()
 	}
 }
 
@@ -364,7 +1086,7 @@ func (c *ServiceClient) FetchDeviceConfigs() ([]rest.ServiceDeviceListItem, erro
 
 // FetchDeviceConfigsAsUpdates requests all device configs for the current
 // service and converts them into DeviceUpdate with DeviceUpdateTypeAdd as the
-// type
+// type. These updates are marked as Bootstrap updates.
 func (c *ServiceClient) FetchDeviceConfigsAsUpdates() ([]DeviceUpdate, error) {
 	// Get The Current Device Config
 	deviceConfigs, err := c.host.RequestServiceDeviceList(c.id)
@@ -373,21 +1095,144 @@ func (c *ServiceClient) FetchDeviceConfigsAsUpdates() ([]DeviceUpdate, error) {
 	}
 	updates := make([]DeviceUpdate, len(deviceConfigs))
 	for i, devConfig := range deviceConfigs {
-		updates[i] = DeviceUpdate{
-			Type:   DeviceUpdateTypeAdd,
-			Id:     devConfig.Id,
-			Topic:  devConfig.PubSub.Topic,
-			Config: devConfig.GetConfigMap(),
-		}
+		updates[i] = deviceUpdateFromListItem(devConfig)
+		updates[i].Bootstrap = true
+		updates[i].ServiceID = c.node.ID
 	}
 	return updates, nil
 }
 
+// DeviceIDPlaceholder is replaced by each device's id in the topic pattern
+// given to PublishDeviceSnapshot
+const DeviceIDPlaceholder = "{deviceid}"
+
+// PublishDeviceSnapshot fetches the current device configs, like
+// FetchDeviceConfigs, and publishes each device's config as a retained JSON
+// message, so that other services can consume the snapshot from the broker.
+// The topic for each device is topicPattern with DeviceIDPlaceholder replaced
+// by the device's id, like "openchirp/snapshot/{deviceid}".
+//
+// A failed publish does not stop the remaining devices from being published.
+// The first error is returned after all devices were attempted.
+func (c *ServiceClient) PublishDeviceSnapshot(topicPattern string) error {
+	if !strings.Contains(topicPattern, DeviceIDPlaceholder) {
+		return fmt.Errorf("%w: %q is missing the %s placeholder", ErrInvalidTopic, topicPattern, DeviceIDPlaceholder)
+	}
+	devices, err := c.FetchDeviceConfigs()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, device := range devices {
+		topic := strings.ReplaceAll(topicPattern, DeviceIDPlaceholder, device.Id)
+		payload, err := json.Marshal(&device)
+		if err == nil {
+			err = c.publishRetained(topic, payload)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("device %s: %w", device.Id, err)
+		}
+	}
+	return firstErr
+}
+
+// RequestDevice publishes a command payload to a device's transducer topic
+// and waits for the device to acknowledge it on the corresponding ack topic
+// (<device topic>/transducer/<transducer>/ack). The first ack payload received
+// is returned. If no ack arrives within timeout, ErrRequestTimeout is
+// returned. The ack subscription is always removed before returning.
+//
+// The device's topic is looked up using an additional REST request.
+// Acks carry no correlation to the command they answer, so requests to the
+// same device transducer are serialized: a request waits until the previous
+// one on the same ack topic has returned before publishing its command.
+// Acks must therefore be published by the device only in response to a
+// command, otherwise a stray ack may be returned to the next request.
+func (c *ServiceClient) RequestDevice(deviceid, transducer string, payload []byte, timeout time.Duration) ([]byte, error) {
+	dev, err := c.FetchDeviceInfo(deviceid)
+	if err != nil {
+		return nil, err
+	}
+	topic := TopicJoin(dev.Pubsub.Topic, TransducerPrefix, transducer)
+	ackTopic := TopicJoin(topic, TransducerAckSubtopic)
+
+	entry := c.acquireRequest(ackTopic)
+	entry.lock.Lock()
+	defer c.releaseRequest(ackTopic, entry)
+
+	acks := make(chan []byte, 1)
+	err = c.Subscribe(ackTopic, func(topic string, payload []byte) {
+		select {
+		case acks <- payload:
+		default:
+			// only the first ack is used
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Unsubscribe(ackTopic)
+
+	if err := c.Publish(topic, payload); err != nil {
+		return nil, err
+	}
+
+	select {
+	case ack := <-acks:
+		return ack, nil
+	case <-time.After(timeout):
+		return nil, ErrRequestTimeout
+	}
+}
+
+// requestEntry serializes the requests on an ack topic. It is counted by the
+// requests using it, so that it is removed once the last one returns.
+type requestEntry struct {
+	lock sync.Mutex
+	refs int
+}
+
+// acquireRequest returns the entry that serializes requests on the given ack
+// topic, counting the caller as a user until releaseRequest
+func (c *ServiceClient) acquireRequest(ackTopic string) *requestEntry {
+	c.requestsLock.Lock()
+	defer c.requestsLock.Unlock()
+	if c.requests == nil {
+		c.requests = make(map[string]*requestEntry)
+	}
+	entry, ok := c.requests[ackTopic]
+	if !ok {
+		entry = new(requestEntry)
+		c.requests[ackTopic] = entry
+	}
+	entry.refs++
+	return entry
+}
+
+// releaseRequest unlocks an entry locked after acquireRequest and removes it
+// if it has no more users
+func (c *ServiceClient) releaseRequest(ackTopic string, entry *requestEntry) {
+	entry.lock.Unlock()
+	c.requestsLock.Lock()
+	defer c.requestsLock.Unlock()
+	if entry.refs--; entry.refs == 0 {
+		delete(c.requests, ackTopic)
+	}
+}
+
 // Subscribe registers a callback for a receiving a given mqtt topic payload
 func (c *ServiceClient) Subscribe(topic string, callback func(topic string, payload []byte)) error {
 	return c.subscribe(topic, callback)
 }
 
+// SubscribeQoS is like Subscribe, but subscribes at the given qos instead of
+// the client's default QoS, which is set by the MQTTQos service property.
+// The subscription is restored with the same qos after a reconnect.
+// ErrInvalidQoS is returned if qos is not 0, 1, or 2.
+func (c *ServiceClient) SubscribeQoS(topic string, qos byte, callback func(topic string, payload []byte)) error {
+	return c.subscribeQoS(topic, qos, callback)
+}
+
 // SubscribeWithClient registers a callback for a receiving a given mqtt
 // topic payload and provides the client object
 func (c *ServiceClient) SubscribeWithClient(topic string, callback ServiceTopicHandler) error {
@@ -396,27 +1241,386 @@ func (c *ServiceClient) SubscribeWithClient(topic string, callback ServiceTopicH
 	})
 }
 
+// SubscribeCtx registers a callback for a receiving a given mqtt topic
+// payload and provides the client object along with a context.
+// The context is derived from the client's lifetime, so it is canceled when
+// the client is stopped, which allows handlers to honor shutdown and to
+// propagate tracing information.
+func (c *ServiceClient) SubscribeCtx(topic string, callback ServiceTopicHandlerCtx) error {
+	return c.subscribeMessage(topic, c.qos, func(message MQTT.Message) {
+		ctx := context.WithValue(c.ctx, messageIDKey{}, message.MessageID())
+		callback(ctx, c, message.Topic(), message.Payload())
+	})
+}
+
+// TappedMessage is a message received by Tail
+type TappedMessage struct {
+	Topic   string
+	Payload []byte
+}
+
+// Tail streams all MQTT traffic under the service's topic
+// (<service topic>/#) for debugging, much like mosquitto_sub scoped to the
+// service. The stream ends and the returned channel is closed once ctx is
+// canceled or the client is stopped.
+// Messages are dropped, instead of stalling the MQTT client, if the channel
+// is not read fast enough.
+// Any number of Tails can run at the same time. They share a single
+// subscription, which is removed once the last Tail ends.
+func (c *ServiceClient) Tail(ctx context.Context) (<-chan TappedMessage, error) {
+	messages := make(chan TappedMessage, tailBuffering)
+	if err := c.addTail(messages); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.ctx.Done():
+		}
+		c.removeTail(messages)
+	}()
+
+	return messages, nil
+}
+
+// tailTopic returns the topic that is subscribed to for Tail
+func (c *ServiceClient) tailTopic() string {
+	return TopicJoin(c.node.Pubsub.Topic, "#")
+}
+
+// addTail registers messages to receive the tapped messages and subscribes
+// to the tail topic, if no other Tail is running
+func (c *ServiceClient) addTail(messages chan TappedMessage) error {
+	c.tailsCtrl.Lock()
+	defer c.tailsCtrl.Unlock()
+
+	if len(c.tails) == 0 {
+		err := c.subscribeMessage(c.tailTopic(), c.qos, c.dispatchTail)
+		if err != nil {
+			return err
+		}
+	}
+	c.tailsLock.Lock()
+	if c.tails == nil {
+		c.tails = make(map[chan TappedMessage]struct{})
+	}
+	c.tails[messages] = struct{}{}
+	c.tailsLock.Unlock()
+	return nil
+}
+
+// removeTail closes messages, after making sure that no more messages are
+// sent to it, and unsubscribes from the tail topic, if it was the last Tail
+func (c *ServiceClient) removeTail(messages chan TappedMessage) {
+	c.tailsCtrl.Lock()
+	defer c.tailsCtrl.Unlock()
+
+	// waits for a dispatch in progress
+	c.tailsLock.Lock()
+	delete(c.tails, messages)
+	last := len(c.tails) == 0
+	c.tailsLock.Unlock()
+
+	if last {
+		c.Unsubscribe(c.tailTopic())
+	}
+	close(messages)
+}
+
+// dispatchTail sends a message on the tail topic to all running Tails
+func (c *ServiceClient) dispatchTail(message MQTT.Message) {
+	c.tailsLock.RLock()
+	defer c.tailsLock.RUnlock()
+	for messages := range c.tails {
+		select {
+		case messages <- TappedMessage{Topic: message.Topic(), Payload: message.Payload()}:
+		default:
+			// drop for a slow reader
+		}
+	}
+}
+
+// SubscribeJSON registers a callback for receiving JSON payloads on a given
+// mqtt topic. Every payload is decoded into a new value from newValue, which
+// should return a pointer, like func() interface{} { return new(MyType) }.
+// Payloads that fail to decode are silently dropped.
+func (c *ServiceClient) SubscribeJSON(topic string, newValue func() interface{}, callback func(topic string, value interface{})) error {
+	return c.SubscribeJSONWithErrors(topic, newValue, callback, nil)
+}
+
+// SubscribeJSONWithErrors is like SubscribeJSON, but payloads that fail to
+// decode are passed to onError, along with the decode error, instead of being
+// dropped. Good payloads are still passed to callback.
+func (c *ServiceClient) SubscribeJSONWithErrors(
+	topic string,
+	newValue func() interface{},
+	callback func(topic string, value interface{}),
+	onError DecodeErrorHandler,
+) error {
+	return c.subscribeCodec(topic, JSONCodec{}, newValue, callback, onError)
+}
+
+// SubscribeDecoded is like SubscribeJSONWithErrors, but payloads are decoded
+// using the client's Codec, as set by WithCodec. The onError handler can be
+// nil, in which case payloads that fail to decode are dropped.
+func (c *ServiceClient) SubscribeDecoded(
+	topic string,
+	newValue func() interface{},
+	callback func(topic string, value interface{}),
+	onError DecodeErrorHandler,
+) error {
+	return c.subscribeCodec(topic, c.codec, newValue, callback, onError)
+}
+
+// subscribeCodec registers a callback for receiving payloads decoded with
+// codec on a given mqtt topic
+func (c *ServiceClient) subscribeCodec(
+	topic string,
+	codec Codec,
+	newValue func() interface{},
+	callback func(topic string, value interface{}),
+	onError DecodeErrorHandler,
+) error {
+	return c.subscribe(topic, func(topic string, payload []byte) {
+		value := newValue()
+		if err := codec.Unmarshal(payload, value); err != nil {
+			if onError != nil {
+				onError(topic, payload, err)
+			}
+			return
+		}
+		callback(topic, value)
+	})
+}
+
 // Unsubscribe deregisters a callback for a given mqtt topic
 func (c *ServiceClient) Unsubscribe(topics ...string) error {
 	return c.unsubscribe(topics...)
 }
 
+// ActiveSubscriptions returns the sorted topics that the client is currently
+// subscribed to, which are restored after a reconnect. This includes the
+// subscriptions made internally, like for device updates.
+func (c *ServiceClient) ActiveSubscriptions() []string {
+	return c.activeSubscriptions()
+}
+
+// UnsubscribeAll deregisters the callbacks of all active subscriptions, as
+// returned by ActiveSubscriptions. Since this includes the internal
+// subscriptions, device updates and the like should be stopped first.
+func (c *ServiceClient) UnsubscribeAll() error {
+	return c.unsubscribeAllCtx(context.Background())
+}
+
 // Publish publishes a payload to a given mqtt topic
 func (c *ServiceClient) Publish(topic string, payload interface{}) error {
 	return c.publish(topic, payload)
 }
 
-// GetProperties returns the full service properties key/value mapping
+// PublishQoS is like Publish, but publishes at the given qos instead of the
+// client's default QoS, which is set by the MQTTQos service property.
+// ErrInvalidQoS is returned if qos is not 0, 1, or 2.
+func (c *ServiceClient) PublishQoS(topic string, qos byte, payload interface{}) error {
+	return c.publishQoS(topic, qos, payload)
+}
+
+// PublishRetained publishes a payload to a given mqtt topic, like Publish,
+// but asks the broker to retain it, so that it is immediately delivered to
+// future subscribers of the topic. Publishing an empty payload clears the
+// retained message.
+func (c *ServiceClient) PublishRetained(topic string, payload interface{}) error {
+	return c.publishRetained(topic, payload)
+}
+
+// PublishCallback publishes a payload to a given mqtt topic, like Publish,
+// but returns immediately instead of waiting for the publish to complete.
+// The optional onComplete is called with the publish's result from a separate
+// goroutine. Since every publish completes independently, the callbacks of
+// several publishes may run concurrently and in any order.
+func (c *ServiceClient) PublishCallback(topic string, payload []byte, onComplete func(error)) {
+	c.publishCallback(topic, payload, onComplete)
+}
+
+// ID returns the service's id
+func (c *ServiceClient) ID() string {
+	return c.node.ID
+}
+
+// PubSub returns the service's pubsub endpoint, which contains its base,
+// events, and status topics
+func (c *ServiceClient) PubSub() rest.ServicePubSub {
+	return c.node.Pubsub
+}
+
+// Topic returns the service's base topic
+func (c *ServiceClient) Topic() string {
+	return c.node.Pubsub.Topic
+}
+
+// EventsTopic returns the topic where the framework server publishes the
+// service's device events
+func (c *ServiceClient) EventsTopic() string {
+	return c.node.Pubsub.TopicEvents
+}
+
+// StatusTopic returns the topic where the service publishes its status
+func (c *ServiceClient) StatusTopic() string {
+	return c.node.Pubsub.TopicStatus
+}
+
+// Name returns the service's name, as provided by the framework server
+func (c *ServiceClient) Name() string {
+	c.nodeLock.RLock()
+	defer c.nodeLock.RUnlock()
+	return c.node.Name
+}
+
+// Version returns the revision of the service's info, as it was when the
+// service client was started or as last updated by StartSchemaUpdates.
+// It can be given to rest.Host's ServiceUpdateVersion to safely update the
+// service.
+func (c *ServiceClient) Version() int {
+	c.nodeLock.RLock()
+	defer c.nodeLock.RUnlock()
+	return c.node.Version
+}
+
+// ConfigParameters returns the service's config parameter schema, as it was
+// when the service client was started or as last updated by
+// StartSchemaUpdates
+func (c *ServiceClient) ConfigParameters() []rest.ServiceConfigParameter {
+	return c.Node().ConfigParameters
+}
+
+// Node returns a copy of the service's info, which the caller may freely
+// modify
+func (c *ServiceClient) Node() rest.ServiceNode {
+	c.nodeLock.RLock()
+	defer c.nodeLock.RUnlock()
+	return c.node.Clone()
+}
+
+// RefreshServiceInfo requests the service's info from the framework server
+// again, bypassing the service info cache, and swaps in its name,
+// description, properties, config parameters, and version, so that a
+// long-lived service picks up changes made on the server without a restart.
+// The id and the pubsub endpoint are kept, so active MQTT subscriptions are
+// not disturbed. It is safe to call concurrently with GetProperty and the
+// other accessors.
+func (c *ServiceClient) RefreshServiceInfo() error {
+	_, err := c.refreshServiceInfo()
+	return err
+}
+
+// refreshServiceInfo is RefreshServiceInfo, which also returns the
+// requested service info
+func (c *ServiceClient) refreshServiceInfo() (rest.ServiceNode, error) {
+	c.host.InvalidateServiceInfo(c.id)
+	node, err := c.host.RequestServiceInfo(c.id)
+	if err != nil {
+		return node, err
+	}
+	c.nodeLock.Lock()
+	c.node.Name = node.Name
+	c.node.Description = node.Description
+	c.node.Properties = node.Properties
+	c.node.ConfigParameters = node.ConfigParameters
+	c.node.Version = node.Version
+	c.nodeLock.Unlock()
+	return node, nil
+}
+
+// StartSchemaUpdates subscribes to the service's schema topic
+// (<service topic>/schema), where changes to the service's config parameters
+// are announced, and keeps the service's info up to date with them. This
+// allows a service to adapt its device config validation without a restart.
+// The announcements are expected to be the service's info JSON, like it is
+// returned by the REST interface, of which only config_required and __v are
+// used. Announcements older than the current version are ignored.
+//
+// The handler is optional and is called with the updated service info after
+// every change. Like StartDeviceUpdatesHandler, it is called synchronously
+// from the MQTT client's message callback.
+func (c *ServiceClient) StartSchemaUpdates(handler func(node rest.ServiceNode)) error {
+	topic := TopicJoin(c.node.Pubsub.Topic, serviceSchemaSubtopic)
+	return c.subscribeMessage(topic, c.qos, func(message MQTT.Message) {
+		var update rest.ServiceNode
+		if err := json.Unmarshal(message.Payload(), &update); err != nil {
+			return
+		}
+		if update.ConfigParameters == nil {
+			// not a schema change
+			return
+		}
+
+		c.nodeLock.Lock()
+		if update.Version < c.node.Version {
+			c.nodeLock.Unlock()
+			return
+		}
+		c.node.ConfigParameters = update.ConfigParameters
+		c.node.Version = update.Version
+		node := c.node.Clone()
+		c.nodeLock.Unlock()
+
+		if handler != nil {
+			handler(node)
+		}
+	})
+}
+
+// StopSchemaUpdates unsubscribes from the service's schema topic
+func (c *ServiceClient) StopSchemaUpdates() error {
+	return c.Unsubscribe(TopicJoin(c.node.Pubsub.Topic, serviceSchemaSubtopic))
+}
+
+// PublishEncoded encodes v using the client's Codec, as set by WithCodec,
+// and publishes it to a given mqtt topic
+func (c *ServiceClient) PublishEncoded(topic string, v interface{}) error {
+	payload, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Publish(topic, payload)
+}
+
+// GetProperties returns a copy of the full service properties key/value
+// mapping, which the caller may freely modify. It is safe to call
+// concurrently with property updates.
 func (c *ServiceClient) GetProperties() map[string]string {
-	return c.node.Properties
+	c.nodeLock.RLock()
+	defer c.nodeLock.RUnlock()
+	properties := make(map[string]string, len(c.node.Properties))
+	for key, value := range c.node.Properties {
+		properties[key] = value
+	}
+	return properties
 }
 
 // GetProperty fetches the service property associated with key. If it does
 // not exist the blank string is returned.
+// The lookup is case-insensitive if the client was started with
+// WithCaseInsensitiveKeys.
 func (c *ServiceClient) GetProperty(key string) string {
+	if c.foldKeys {
+		return c.GetPropertyFold(key)
+	}
+	c.nodeLock.RLock()
+	defer c.nodeLock.RUnlock()
 	value, ok := c.node.Properties[key]
 	if ok {
 		return value
 	}
 	return ""
 }
+
+// GetPropertyFold fetches the service property associated with key, ignoring
+// the case of the property keys. An exact match is preferred.
+// If it does not exist the blank string is returned.
+func (c *ServiceClient) GetPropertyFold(key string) string {
+	c.nodeLock.RLock()
+	defer c.nodeLock.RUnlock()
+	value, _ := rest.LookupFold(c.node.Properties, key)
+	return value
+}
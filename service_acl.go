@@ -0,0 +1,137 @@
+package framework
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/openchirp/framework/rest"
+)
+
+// aclProbeAction is the action of the probe messages published by
+// ProbeDeviceUpdatesACL
+const aclProbeAction = "aclprobe"
+
+type aclProbeMessage struct {
+	Action string `json:"action"`
+	Nonce  string `json:"nonce"`
+}
+
+// parseACLProbe returns the nonce of a probe message, or false if payload is
+// not a probe message
+func parseACLProbe(payload []byte) (string, bool) {
+	var msg aclProbeMessage
+	if json.Unmarshal(payload, &msg) != nil || msg.Action != aclProbeAction || msg.Nonce == "" {
+		return "", false
+	}
+	return msg.Nonce, true
+}
+
+// isOwnACLProbe tells if payload is a probe message that was published by
+// this client and not yet received, like a probe that arrived too late.
+// Such a probe is only reported once.
+func (c *ServiceClient) isOwnACLProbe(payload []byte) bool {
+	nonce, ok := parseACLProbe(payload)
+	if !ok {
+		return false
+	}
+	c.probesLock.Lock()
+	defer c.probesLock.Unlock()
+	if !c.probes[nonce] {
+		return false
+	}
+	delete(c.probes, nonce)
+	return true
+}
+
+// ACLProbe is the result of probing a single topic with ProbeDeviceUpdatesACL
+type ACLProbe struct {
+	Topic string
+	// Delivered indicates if the probe message made the round trip
+	Delivered bool
+	// PublishErr is the error of publishing the probe message, if any, in
+	// which case the topic could not be checked
+	PublishErr error
+}
+
+// ProbeDeviceUpdatesACL checks that the topics of the device updates
+// subscription are effectively deliverable, since some brokers grant a
+// subscription, but then deliver nothing because of their topic ACLs.
+// Every topic is subscribed and a probe message is published to it, which
+// must be received within timeout. Topics whose probe was not delivered are
+// most likely dead.
+//
+// Since a broker may also silently drop a publish that its ACLs deny, an
+// undelivered probe can also mean that the service may not publish to the
+// topic. Probes of this client that arrive late are ignored by its device
+// updates, but other consumers of the topics will see them.
+// It must be called before device updates are started, otherwise
+// ErrDeviceUpdatesAlreadyStarted is returned.
+func (c *ServiceClient) ProbeDeviceUpdatesACL(timeout time.Duration) ([]ACLProbe, error) {
+	c.updatesCtrl.Lock()
+	defer c.updatesCtrl.Unlock()
+
+	c.updatesLock.RLock()
+	running := c.updatesRunning
+	c.updatesLock.RUnlock()
+	if running {
+		return nil, ErrDeviceUpdatesAlreadyStarted
+	}
+
+	topics := c.deviceUpdatesTopics()
+	probes := make([]ACLProbe, 0, len(topics))
+	for _, topic := range topics {
+		probe, err := c.probeTopic(topic, timeout)
+		if err != nil {
+			return probes, err
+		}
+		probes = append(probes, probe)
+	}
+	return probes, nil
+}
+
+// probeTopic subscribes to topic and waits for a published probe message to
+// be delivered. Only subscribe errors are returned as an error.
+func (c *ServiceClient) probeTopic(topic string, timeout time.Duration) (ACLProbe, error) {
+	probe := ACLProbe{Topic: topic}
+	nonce := rest.NewRequestID()
+	payload, err := json.Marshal(aclProbeMessage{Action: aclProbeAction, Nonce: nonce})
+	if err != nil {
+		return probe, err
+	}
+
+	received := make(chan struct{}, 1)
+	err = c.subscribeQoS(topic, c.deviceUpdatesQoS, func(topic string, p []byte) {
+		if n, ok := parseACLProbe(p); ok && n == nonce {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		return probe, err
+	}
+	defer c.unsubscribe(topic)
+
+	// remember the probe, so that it is ignored if it arrives late
+	c.probesLock.Lock()
+	if c.probes == nil {
+		c.probes = make(map[string]bool)
+	}
+	c.probes[nonce] = true
+	c.probesLock.Unlock()
+
+	if probe.PublishErr = c.publish(topic, payload); probe.PublishErr == nil {
+		select {
+		case <-received:
+			probe.Delivered = true
+		case <-time.After(timeout):
+		}
+	}
+	if probe.Delivered || probe.PublishErr != nil {
+		c.probesLock.Lock()
+		delete(c.probes, nonce)
+		c.probesLock.Unlock()
+	}
+	return probe, nil
+}
@@ -0,0 +1,98 @@
+package framework
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// serviceHeartbeatSubtopic is the service subtopic that heartbeats are
+// published to, if StartHeartbeat is given no topic
+const serviceHeartbeatSubtopic = "heartbeat"
+
+// ErrHeartbeatAlreadyStarted is returned when starting a second heartbeat
+var ErrHeartbeatAlreadyStarted = errors.New("Heartbeat already started")
+
+// ErrInvalidHeartbeatInterval is returned for a heartbeat interval that is
+// not positive
+var ErrInvalidHeartbeatInterval = errors.New("Heartbeat interval must be positive")
+
+// serviceHeartbeat describes the JSON blob published as a heartbeat
+type serviceHeartbeat struct {
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// StartHeartbeat periodically publishes the current time to topic, so that
+// a monitor can detect a wedged service, even while its MQTT connection is
+// alive. If topic is empty, the service's heartbeat topic
+// (<service topic>/heartbeat) is used. The first heartbeat is published
+// right away and then one every interval, as the following JSON object:
+//
+//	{"timestamp": "2017-06-01T12:00:00Z"}
+//
+// The heartbeat runs until StopHeartbeat or StopClient is called. Failed
+// publishes are logged and do not stop the heartbeat.
+func (c *ServiceClient) StartHeartbeat(interval time.Duration, topic string) error {
+	if interval <= 0 {
+		return ErrInvalidHeartbeatInterval
+	}
+	if topic == "" {
+		topic = TopicJoin(c.node.Pubsub.Topic, serviceHeartbeatSubtopic)
+	}
+	if err := ValidatePublishTopic(topic); err != nil {
+		return err
+	}
+
+	c.heartbeatLock.Lock()
+	defer c.heartbeatLock.Unlock()
+	if c.heartbeatStop != nil {
+		return ErrHeartbeatAlreadyStarted
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	c.heartbeatStop = stop
+	c.heartbeatDone = done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			c.publishHeartbeat(topic)
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// StopHeartbeat stops the heartbeat started by StartHeartbeat and waits for
+// a heartbeat publish in progress. It is safe to call when no heartbeat is
+// running.
+func (c *ServiceClient) StopHeartbeat() {
+	c.heartbeatLock.Lock()
+	defer c.heartbeatLock.Unlock()
+	if c.heartbeatStop == nil {
+		return
+	}
+	close(c.heartbeatStop)
+	<-c.heartbeatDone
+	c.heartbeatStop = nil
+	c.heartbeatDone = nil
+}
+
+// publishHeartbeat publishes a single heartbeat to topic
+func (c *ServiceClient) publishHeartbeat(topic string) {
+	payload, err := json.Marshal(&serviceHeartbeat{Timestamp: time.Now().UTC()})
+	if err == nil {
+		err = c.Publish(topic, payload)
+	}
+	if err != nil {
+		c.logf("Failed to publish heartbeat to %s: %v", topic, err)
+	}
+}
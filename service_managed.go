@@ -7,7 +7,6 @@ package framework
 
 import (
 	"fmt"
-	"log"
 	"strings"
 	"sync"
 
@@ -35,7 +34,12 @@ func (m *serviceManager) runtime() {
 
 	for {
 		select {
-		case update := <-m.updates:
+		case update, ok := <-m.updates:
+			if !ok {
+				// device updates were stopped, wait for the shutdown
+				m.updates = nil
+				continue
+			}
 			switch update.Type {
 			case DeviceUpdateTypeRem:
 				m.removeDevice(update.Id)
@@ -97,7 +101,7 @@ func (m *serviceManager) addUpdateDevice(deviceid string, topic string, config m
 			// Do not allow keys to be missing, since we do not expect users to
 			// to understand missing keys on updates - we will remove and re-add
 			// TODO: Should probably log, since this may be a REST bug
-			log.Printf("missing keys, but the changes were: %v", cchanges)
+			m.c.logf("missing keys, but the changes were: %v", cchanges)
 			m.removeDevice(deviceid)
 			m.addUpdateDevice(deviceid, topic, config)
 			return
@@ -203,7 +207,7 @@ func (m *serviceManager) deviceUnsubscribeAll(dState *deviceState) {
 func (m *serviceManager) deviceUnsubscribe(dState *deviceState, subtopics ...string) {
 	// Prepend the device endpoint and remove from device subscription list
 	for i, subtopic := range subtopics {
-		topic := dState.topic + "/" + subtopic
+		topic := TopicJoin(dState.topic, subtopic)
 		subtopics[i] = topic
 		delete(dState.subs, topic)
 	}
@@ -217,7 +221,7 @@ func (m *serviceManager) deviceUnsubscribe(dState *deviceState, subtopics ...str
 // Messages received on the subscribed topic will be sent to the device's
 // ProcessMessage handler with the specified key and subtopic.
 func (m *serviceManager) deviceSubscribe(dState *deviceState, subtopic string, key interface{}) {
-	stopic := dState.topic + "/" + subtopic
+	stopic := TopicJoin(dState.topic, subtopic)
 	if _, ok := dState.subs[stopic]; !ok {
 		m.c.Subscribe(stopic, func(topic string, payload []byte) {
 			// Get the device level subtopic
@@ -239,7 +243,7 @@ func (m *serviceManager) deviceSubscribe(dState *deviceState, subtopic string, k
 
 // devicePublish publishes to a topic within the device's subtopic space
 func (m *serviceManager) devicePublish(dState *deviceState, subtopic string, payload interface{}) {
-	topic := dState.topic + "/" + subtopic
+	topic := TopicJoin(dState.topic, subtopic)
 	m.c.Publish(topic, payload)
 }
 
@@ -260,13 +264,14 @@ func StartServiceClientManaged(
 	token,
 	statusmsg string,
 	newdevice func() Device,
+	opts ...ClientOption,
 ) (*ServiceClient, error) {
 
 	if newdevice == nil {
 		return nil, fmt.Errorf("Error: newdevice cannot be nil")
 	}
 
-	c, err := StartServiceClientStatus(frameworkuri, brokeruri, id, token, statusmsg)
+	c, err := StartServiceClientStatus(frameworkuri, brokeruri, id, token, statusmsg, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,68 @@
+package framework
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ServiceErrors aggregates the errors of an operation that was applied to
+// multiple services, keyed by service id
+type ServiceErrors map[string]error
+
+func (e ServiceErrors) Error() string {
+	ids := make([]string, 0, len(e))
+	for id := range e {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		msgs[i] = fmt.Sprintf("%s: %v", id, e[id])
+	}
+	return fmt.Sprintf("%d service(s) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// MergeDeviceUpdates starts the device updates of every given service client,
+// like StartDeviceUpdatesSimple, and merges them into a single channel.
+// Every update carries the id of its service in DeviceUpdate.ServiceID.
+//
+// The services are independent of each other. If some of them fail to start,
+// the others are still merged and the failures are returned as ServiceErrors,
+// along with the merged channel. The channel is only nil if all of them
+// failed. The merged channel is closed once the device updates of all started
+// services are stopped, using StopDeviceUpdates or StopClient on each of them.
+// It should be read until then.
+func MergeDeviceUpdates(clients ...*ServiceClient) (<-chan DeviceUpdate, error) {
+	merged := make(chan DeviceUpdate)
+	errs := make(ServiceErrors)
+	var wg sync.WaitGroup
+
+	for _, c := range clients {
+		updates, err := c.StartDeviceUpdatesSimple()
+		if err != nil {
+			errs[c.ID()] = err
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for update := range updates {
+				merged <- update
+			}
+		}()
+	}
+
+	if len(errs) == len(clients) && len(clients) > 0 {
+		return nil, errs
+	}
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+	if len(errs) > 0 {
+		return merged, errs
+	}
+	return merged, nil
+}
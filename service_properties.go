@@ -0,0 +1,166 @@
+package framework
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/openchirp/framework/rest"
+)
+
+const (
+	// servicePropertiesSubtopic is the service subtopic that service
+	// property changes are announced on
+	servicePropertiesSubtopic = "properties"
+	// propertyUpdatesBuffering is the number of property updates buffered
+	// for the consumer of the property updates channel
+	propertyUpdatesBuffering = 10
+)
+
+// ErrPropertyUpdatesAlreadyStarted is returned when starting property
+// updates a second time
+var ErrPropertyUpdatesAlreadyStarted = errors.New("Property updates channel already started")
+
+// PropertyUpdate is a change of a single service property
+type PropertyUpdate struct {
+	// Key is the property's key
+	Key string
+	// Value is the property's new value, which is empty if it was removed
+	Value string
+	// Removed is set if the property no longer exists
+	Removed bool
+}
+
+// StartPropertyUpdates subscribes to the service's properties topic
+// (<service topic>/properties), where changes to the service's properties
+// are announced, and keeps the service's properties up to date with them, so
+// that GetProperty and GetProperties return the new values. This allows a
+// service to react to an operator changing a property, like a feature flag,
+// without a restart.
+// The announcements are expected to be the service's info JSON, like it is
+// returned by the REST interface, of which only properties and __v are used.
+// Announcements older than the current version are ignored.
+//
+// Every added, changed, or removed property is sent as a PropertyUpdate on
+// the returned channel, ordered by key for each announcement. The properties
+// are updated before the channel is sent to. Like the device updates
+// channel, the channel must be read, since a full channel blocks the MQTT
+// client's message callback. Use StopPropertyUpdates to stop the updates.
+func (c *ServiceClient) StartPropertyUpdates() (<-chan PropertyUpdate, error) {
+	c.propsCtrl.Lock()
+	defer c.propsCtrl.Unlock()
+
+	c.propsLock.Lock()
+	if c.propsRunning {
+		c.propsLock.Unlock()
+		return nil, ErrPropertyUpdatesAlreadyStarted
+	}
+	updates := make(chan PropertyUpdate, propertyUpdatesBuffering)
+	stop := make(chan struct{})
+	c.propsRunning = true
+	c.propsUpdates = updates
+	c.propsStop = stop
+	c.propsLock.Unlock()
+
+	topic := TopicJoin(c.node.Pubsub.Topic, servicePropertiesSubtopic)
+	err := c.subscribeMessage(topic, c.qos, func(message MQTT.Message) {
+		// The read lock is held for the whole delivery, so that
+		// StopPropertyUpdates can wait for deliveries in progress
+		c.propsLock.RLock()
+		defer c.propsLock.RUnlock()
+		if !c.propsRunning {
+			return
+		}
+		for _, update := range c.applyPropertyUpdate(message.Payload()) {
+			select {
+			case updates <- update:
+			case <-stop:
+				// updates are being stopped, so discard instead of blocking
+				return
+			}
+		}
+	})
+	if err != nil {
+		c.stopPropertyUpdates()
+		return nil, err
+	}
+	return updates, nil
+}
+
+// StopPropertyUpdates unsubscribes from the service's properties topic and
+// closes the property updates channel. It is safe to call when property
+// updates are not running. The consumer of the channel does not need to keep
+// reading for StopPropertyUpdates to return.
+func (c *ServiceClient) StopPropertyUpdates() {
+	c.propsCtrl.Lock()
+	defer c.propsCtrl.Unlock()
+	c.stopPropertyUpdates()
+}
+
+// stopPropertyUpdates stops the property updates like
+// stopDeviceUpdatesDelivery does for device updates. The caller must hold
+// propsCtrl.
+func (c *ServiceClient) stopPropertyUpdates() {
+	c.propsLock.RLock()
+	running := c.propsRunning
+	c.propsLock.RUnlock()
+	if !running {
+		return
+	}
+
+	close(c.propsStop)
+	c.Unsubscribe(TopicJoin(c.node.Pubsub.Topic, servicePropertiesSubtopic))
+
+	// wait for all running deliveries to finish
+	c.propsLock.Lock()
+	c.propsRunning = false
+	c.propsLock.Unlock()
+
+	close(c.propsUpdates)
+	c.propsUpdates = nil
+}
+
+// applyPropertyUpdate applies a properties announcement to the service's
+// info and returns the property changes it made
+func (c *ServiceClient) applyPropertyUpdate(payload []byte) []PropertyUpdate {
+	var announced rest.ServiceNode
+	if err := json.Unmarshal(payload, &announced); err != nil {
+		c.logf("Failed to parse service properties update: %v", err)
+		return nil
+	}
+	if announced.Properties == nil {
+		// not a properties change
+		return nil
+	}
+
+	c.nodeLock.Lock()
+	defer c.nodeLock.Unlock()
+	if announced.Version < c.node.Version {
+		return nil
+	}
+	updates := diffProperties(c.node.Properties, announced.Properties)
+	c.node.Properties = announced.Properties
+	c.node.Version = announced.Version
+	return updates
+}
+
+// diffProperties returns the changes from the old to the new properties,
+// ordered by key
+func diffProperties(old, new map[string]string) []PropertyUpdate {
+	var updates []PropertyUpdate
+	for key, value := range new {
+		if oldValue, ok := old[key]; !ok || oldValue != value {
+			updates = append(updates, PropertyUpdate{Key: key, Value: value})
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			updates = append(updates, PropertyUpdate{Key: key, Removed: true})
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Key < updates[j].Key
+	})
+	return updates
+}
@@ -0,0 +1,1352 @@
+package framework_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/openchirp/framework"
+	"github.com/openchirp/framework/rest"
+)
+
+const (
+	testServiceTopic       = "openchirp/service/592880c57d6ec25f901d9668"
+	testServiceEventsTopic = testServiceTopic + "/thing/events"
+)
+
+// fakeToken is an always completed MQTT token
+type fakeToken struct {
+	err error
+}
+
+func (t fakeToken) Wait() bool                     { return true }
+func (t fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (t fakeToken) Error() error                   { return t.err }
+
+// blockingToken is an MQTT token that completes once done is closed
+type blockingToken struct {
+	done chan struct{}
+}
+
+func (t blockingToken) Wait() bool { <-t.done; return true }
+func (t blockingToken) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+func (t blockingToken) Error() error { return nil }
+
+// fakeMessage is a received MQTT message
+type fakeMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+	qos      byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return m.qos }
+func (m fakeMessage) Retained() bool    { return m.retained }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+// fakeMQTT is an in memory MQTT client that delivers messages straight to
+// the subscribed handlers, from the goroutine calling deliver
+type fakeMQTT struct {
+	lock      sync.Mutex
+	handlers  map[string]MQTT.MessageHandler
+	published []fakeMessage
+	// subscribedQoS is the qos of every subscribe, by topic
+	subscribedQoS map[string]byte
+	// subscribeBlock, if set, blocks subscribes until it is closed
+	subscribeBlock chan struct{}
+	// publishBlock, if set, blocks publishes until it is closed
+	publishBlock chan struct{}
+	// subscribeErr, if set, fails all subscribes
+	subscribeErr error
+	// loopback delivers published messages to the subscribed handlers
+	loopback bool
+}
+
+func newFakeMQTT() *fakeMQTT {
+	return &fakeMQTT{
+		handlers:      make(map[string]MQTT.MessageHandler),
+		subscribedQoS: make(map[string]byte),
+	}
+}
+
+func (f *fakeMQTT) deliver(topic string, payload []byte) {
+	f.lock.Lock()
+	handler := f.handlers[topic]
+	f.lock.Unlock()
+	if handler != nil {
+		handler(f, fakeMessage{topic: topic, payload: payload})
+	}
+}
+
+func (f *fakeMQTT) IsConnected() bool      { return true }
+func (f *fakeMQTT) IsConnectionOpen() bool { return true }
+func (f *fakeMQTT) Connect() MQTT.Token    { return fakeToken{} }
+func (f *fakeMQTT) Disconnect(uint)        {}
+
+func (f *fakeMQTT) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	f.lock.Lock()
+	p, _ := payload.([]byte)
+	f.published = append(f.published, fakeMessage{topic: topic, payload: p, retained: retained, qos: qos})
+	loopback := f.loopback
+	block := f.publishBlock
+	f.lock.Unlock()
+	if loopback {
+		f.deliver(topic, p)
+	}
+	if block != nil {
+		return blockingToken{done: block}
+	}
+	return fakeToken{}
+}
+
+func (f *fakeMQTT) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.subscribeErr != nil {
+		return fakeToken{err: f.subscribeErr}
+	}
+	f.handlers[topic] = callback
+	f.subscribedQoS[topic] = qos
+	if f.subscribeBlock != nil {
+		return blockingToken{done: f.subscribeBlock}
+	}
+	return fakeToken{}
+}
+
+func (f *fakeMQTT) SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token {
+	for topic, qos := range filters {
+		f.Subscribe(topic, qos, callback)
+	}
+	return fakeToken{}
+}
+
+func (f *fakeMQTT) Unsubscribe(topics ...string) MQTT.Token {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, topic := range topics {
+		delete(f.handlers, topic)
+	}
+	return fakeToken{}
+}
+
+func (f *fakeMQTT) AddRoute(topic string, callback MQTT.MessageHandler) {}
+
+func (f *fakeMQTT) OptionsReader() MQTT.ClientOptionsReader {
+	return MQTT.ClientOptionsReader{}
+}
+
+func newTestServiceClient(mqtt MQTT.Client, opts ...framework.ClientOption) *framework.ServiceClient {
+	var node rest.ServiceNode
+	node.ID = "592880c57d6ec25f901d9668"
+	node.Pubsub.Topic = testServiceTopic
+	node.Pubsub.TopicEvents = testServiceEventsTopic
+	return framework.NewServiceClientWith(node, mqtt, rest.NewHost(""), opts...)
+}
+
+func TestParseDeviceUpdate(t *testing.T) {
+	payload := []byte(`{
+		"action":"update",
+		"thing":{
+			"type":"device",
+			"id":"5930aaf27d6ec25f901d96da",
+			"pubsub": {
+				"protocol": "MQTT",
+				"endpoint": "openchirp/device/5930aaf27d6ec25f901d96da"
+			},
+			"config":[
+				{"key":"rxconfig","value":"[]"},
+				{"key":"txconfig","value":"[1]"}]
+		}
+	}`)
+
+	update, err := framework.ParseDeviceUpdate(payload)
+	if err != nil {
+		t.Error("Error parsing device update:", err)
+		return
+	}
+	if update.Type != framework.DeviceUpdateTypeUpd {
+		t.Error("Unexpected update type:", update.Type)
+	}
+	if update.Id != "5930aaf27d6ec25f901d96da" {
+		t.Error("Unexpected device id:", update.Id)
+	}
+	if update.Topic != "openchirp/device/5930aaf27d6ec25f901d96da" {
+		t.Error("Unexpected device topic:", update.Topic)
+	}
+	if len(update.Config) != 2 || update.Config["txconfig"] != "[1]" {
+		t.Error("Unexpected device config:", update.Config)
+	}
+}
+
+func TestParseDeviceUpdate_Errors(t *testing.T) {
+	if _, err := framework.ParseDeviceUpdate([]byte(`{"action":`)); err == nil {
+		t.Error("Expected an error for malformed JSON")
+	}
+
+	_, err := framework.ParseDeviceUpdate([]byte(`{"action":"explode","thing":{}}`))
+	if !errors.Is(err, framework.ErrUnknownDeviceUpdateAction) {
+		t.Error("Expected ErrUnknownDeviceUpdateAction, but got:", err)
+	}
+}
+
+func TestServiceClient_StopDeviceUpdatesAfterFailedStart(t *testing.T) {
+	subscribeErr := errors.New("subscribe failed")
+	mqtt := newFakeMQTT()
+	mqtt.subscribeErr = subscribeErr
+	c := newTestServiceClient(mqtt)
+	defer c.StopClient()
+
+	if _, err := c.StartDeviceUpdates(); err != subscribeErr {
+		t.Fatal("Expected the subscribe error, but got:", err)
+	}
+	c.StopDeviceUpdates()
+	c.StopDeviceUpdates()
+	if err := c.StartDeviceUpdatesWorkers(2, func(framework.DeviceUpdate) {}); err != subscribeErr {
+		t.Fatal("Expected the subscribe error, but got:", err)
+	}
+	c.StopDeviceUpdates()
+
+	// updates can still be started and stopped repeatedly after a failure
+	mqtt.lock.Lock()
+	mqtt.subscribeErr = nil
+	mqtt.lock.Unlock()
+	updates, err := c.StartDeviceUpdates()
+	if err != nil {
+		t.Fatal("Failed to start device updates:", err)
+	}
+	c.StopDeviceUpdates()
+	c.StopDeviceUpdates()
+	if _, ok := <-updates; ok {
+		t.Error("Device updates channel was not closed")
+	}
+
+	var nilClient *framework.ServiceClient
+	nilClient.StopDeviceUpdates()
+}
+
+func TestServiceClient_StopDeviceUpdatesUnderLoad(t *testing.T) {
+	payload := []byte(`{"action":"update","thing":{"id":"5930aaf27d6ec25f901d96da","config":[]}}`)
+
+	modes := []string{"StopDeviceUpdates", "StopClient", "Handler", "Workers"}
+	for iteration := 0; iteration < 10; iteration++ {
+		for _, mode := range modes {
+			mqtt := newFakeMQTT()
+			c := newTestServiceClient(mqtt)
+
+			var updates <-chan framework.DeviceUpdate
+			var err error
+			switch mode {
+			case "Handler":
+				err = c.StartDeviceUpdatesHandler(func(framework.DeviceUpdate) {})
+			case "Workers":
+				err = c.StartDeviceUpdatesWorkers(4, func(framework.DeviceUpdate) {
+					time.Sleep(time.Microsecond)
+				})
+			default:
+				updates, err = c.StartDeviceUpdates()
+			}
+			if err != nil {
+				t.Fatal("Failed to start device updates:", err)
+			}
+
+			// publish at a high rate from several callback goroutines
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for p := 0; p < 4; p++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							mqtt.deliver(testServiceEventsTopic, payload)
+						}
+					}
+				}()
+			}
+
+			// read a few updates and then abandon the channel, so
+			// that the callbacks block on a full queue
+			if updates != nil {
+				for i := 0; i < 5; i++ {
+					<-updates
+				}
+			}
+			time.Sleep(time.Millisecond)
+
+			done := make(chan struct{})
+			go func() {
+				if mode != "StopClient" {
+					c.StopDeviceUpdates()
+				}
+				c.StopClient()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: shutdown deadlocked", mode)
+			}
+
+			close(stop)
+			wg.Wait()
+
+			// the updates channel must end up closed
+			if updates != nil {
+				for range updates {
+				}
+			}
+		}
+	}
+}
+
+func TestServiceClient_Tail(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, err := c.Tail(ctx)
+	if err != nil {
+		t.Fatal("Failed to tail:", err)
+	}
+
+	// the fake client only routes exact subscriptions
+	mqtt.deliver(testServiceTopic+"/#", []byte("hello"))
+	msg := <-messages
+	if string(msg.Payload) != "hello" {
+		t.Error("Unexpected tapped payload:", string(msg.Payload))
+	}
+
+	cancel()
+	for range messages {
+	}
+	mqtt.deliver(testServiceTopic+"/#", []byte("late"))
+}
+
+func TestServiceClient_TailShared(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	messages1, err := c.Tail(ctx1)
+	if err != nil {
+		t.Fatal("Failed to tail:", err)
+	}
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	messages2, err := c.Tail(ctx2)
+	if err != nil {
+		t.Fatal("Failed to tail:", err)
+	}
+
+	// stopping one Tail must not stop the other
+	cancel1()
+	for range messages1 {
+	}
+	mqtt.deliver(testServiceTopic+"/#", []byte("hello"))
+	select {
+	case msg := <-messages2:
+		if string(msg.Payload) != "hello" {
+			t.Error("Unexpected tapped payload:", string(msg.Payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Remaining Tail did not receive the message")
+	}
+
+	cancel2()
+	for range messages2 {
+	}
+	mqtt.lock.Lock()
+	_, subscribed := mqtt.handlers[testServiceTopic+"/#"]
+	mqtt.lock.Unlock()
+	if subscribed {
+		t.Error("Tail topic is still subscribed after the last Tail ended")
+	}
+}
+
+func TestServiceClient_StartSchemaUpdates(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+
+	updates := make(chan rest.ServiceNode, 1)
+	if err := c.StartSchemaUpdates(func(node rest.ServiceNode) { updates <- node }); err != nil {
+		t.Fatal("Failed to start schema updates:", err)
+	}
+
+	topic := testServiceTopic + "/schema"
+	mqtt.deliver(topic, []byte(`{"__v":2,"config_required":[{"key_name":"rate","key_required":true}]}`))
+	node := <-updates
+	if len(node.ConfigParameters) != 1 || node.ConfigParameters[0].Name != "rate" {
+		t.Error("Unexpected schema update:", node.ConfigParameters)
+	}
+	if c.Version() != 2 || len(c.ConfigParameters()) != 1 {
+		t.Error("Service info was not refreshed")
+	}
+
+	// older announcements and other service info changes are ignored
+	mqtt.deliver(topic, []byte(`{"__v":1,"config_required":[]}`))
+	mqtt.deliver(topic, []byte(`{"__v":3,"name":"renamed"}`))
+	if c.Version() != 2 || len(c.ConfigParameters()) != 1 {
+		t.Error("Service info was unexpectedly changed")
+	}
+	select {
+	case node := <-updates:
+		t.Error("Unexpected schema update:", node)
+	default:
+	}
+}
+
+func TestServiceClient_UpdatesWatchdogDrop(t *testing.T) {
+	payload := []byte(`{"action":"new","thing":{"id":"5930aaf27d6ec25f901d96da","config":[]}}`)
+	stalls := make(chan struct{}, 10)
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt, framework.WithUpdatesWatchdog(10*time.Millisecond,
+		framework.StalledUpdatesDrop, func() { stalls <- struct{}{} }))
+	defer c.StopClient()
+
+	updates, err := c.StartDeviceUpdates()
+	if err != nil {
+		t.Fatal("Failed to start device updates:", err)
+	}
+
+	// nobody reads, but the callbacks must not stay blocked
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			mqtt.deliver(testServiceEventsTopic, payload)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Callbacks stayed blocked on a stalled consumer")
+	}
+	if len(stalls) != 1 {
+		t.Error("Expected a single stall notification, but got", len(stalls))
+	}
+
+	// a returning consumer receives new updates again
+	go mqtt.deliver(testServiceEventsTopic, payload)
+	select {
+	case <-updates:
+	case <-time.After(5 * time.Second):
+		t.Error("Returning consumer did not receive updates")
+	}
+}
+
+func TestMergeDeviceUpdates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/apiv1/service/s1/things" {
+			w.Write([]byte(`[{"id":"d1","config":[]}]`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	newClient := func(id string) *framework.ServiceClient {
+		var node rest.ServiceNode
+		node.ID = id
+		node.Pubsub.TopicEvents = "openchirp/service/" + id + "/thing/events"
+		return framework.NewServiceClientWith(node, newFakeMQTT(), rest.NewHost(server.URL))
+	}
+	good, bad := newClient("s1"), newClient("s2")
+
+	updates, err := framework.MergeDeviceUpdates(good, bad)
+	if errs, ok := err.(framework.ServiceErrors); !ok || len(errs) != 1 || errs["s2"] == nil {
+		t.Error("Expected only s2 to fail, but got:", err)
+	}
+	if updates == nil {
+		t.Fatal("Expected the merged updates of s1")
+	}
+
+	update := <-updates
+	if update.ServiceID != "s1" || update.Id != "d1" {
+		t.Error("Unexpected merged update:", update)
+	}
+
+	good.StopDeviceUpdates()
+	for range updates {
+	}
+}
+
+func TestServiceClient_RunDeviceUpdates(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"d1","config":[]},{"id":"d2","config":[]}]`))
+	}))
+	defer server.Close()
+
+	var node rest.ServiceNode
+	node.ID = "s1"
+	node.Pubsub.TopicEvents = testServiceEventsTopic
+	c := framework.NewServiceClientWith(node, newFakeMQTT(), rest.NewHost(server.URL))
+
+	var wg sync.WaitGroup
+	var handled []string
+	var stop func()
+	started := make(chan struct{})
+	stop, done, err := c.RunDeviceUpdates(&wg, func(update framework.DeviceUpdate) {
+		handled = append(handled, update.Id)
+		// stopping from within the handler must not deadlock
+		<-started
+		stop()
+	})
+	if err != nil {
+		t.Fatal("Failed to run device updates:", err)
+	}
+	close(started)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Update pump did not exit")
+	}
+	wg.Wait()
+	stop()
+	if len(handled) == 0 || handled[0] != "d1" {
+		t.Error("Unexpected handled updates:", handled)
+	}
+}
+
+func TestServiceClient_PublishCallback(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+
+	results := make(chan error, 2)
+	c.PublishCallback(testServiceTopic+"/data", []byte("1"), func(err error) { results <- err })
+	c.PublishCallback(testServiceTopic+"/#", []byte("2"), func(err error) { results <- err })
+
+	var failed int
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			if !errors.Is(err, framework.ErrInvalidTopic) {
+				t.Error("Unexpected publish error:", err)
+			}
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Error("Expected only the wildcard publish to fail, but got", failed)
+	}
+	mqtt.lock.Lock()
+	defer mqtt.lock.Unlock()
+	if len(mqtt.published) != 1 || string(mqtt.published[0].payload) != "1" {
+		t.Error("Unexpected published messages:", mqtt.published)
+	}
+}
+
+// fakeMQTTv5 is a fakeMQTT that carries user properties, like a v5 client
+type fakeMQTTv5 struct {
+	*fakeMQTT
+	props []map[string]string
+}
+
+// fakeMessageProps is a received MQTT message with user properties
+type fakeMessageProps struct {
+	fakeMessage
+	props map[string]string
+}
+
+func (m fakeMessageProps) UserProperties() map[string]string { return m.props }
+
+func (f *fakeMQTTv5) PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props map[string]string) MQTT.Token {
+	f.lock.Lock()
+	f.props = append(f.props, props)
+	f.lock.Unlock()
+	return f.Publish(topic, qos, retained, payload)
+}
+
+func (f *fakeMQTTv5) deliverProps(topic string, payload []byte, props map[string]string) {
+	f.lock.Lock()
+	handler := f.handlers[topic]
+	f.lock.Unlock()
+	if handler != nil {
+		handler(f, fakeMessageProps{fakeMessage{topic: topic, payload: payload}, props})
+	}
+}
+
+func TestServiceClient_UserProperties(t *testing.T) {
+	topic := testServiceTopic + "/data"
+
+	c := newTestServiceClient(newFakeMQTT())
+	if c.SupportsUserProperties() {
+		t.Error("A v3 client should not support user properties")
+	}
+	if err := c.PublishWithProperties(topic, []byte("1"), nil); err != framework.ErrUserPropertiesUnsupported {
+		t.Error("Expected ErrUserPropertiesUnsupported, but got:", err)
+	}
+
+	mqtt := &fakeMQTTv5{fakeMQTT: newFakeMQTT()}
+	c = newTestServiceClient(mqtt)
+	if !c.SupportsUserProperties() {
+		t.Error("A v5 client should support user properties")
+	}
+
+	var received []map[string]string
+	err := c.SubscribeWithProperties(topic, func(topic string, payload []byte, props map[string]string) {
+		received = append(received, props)
+	})
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	mqtt.deliverProps(topic, []byte("1"), map[string]string{"correlation": "abc"})
+	mqtt.deliver(topic, []byte("2"))
+	if len(received) != 2 || received[0]["correlation"] != "abc" || received[1] != nil {
+		t.Error("Unexpected received properties:", received)
+	}
+
+	if err := c.PublishWithProperties(topic, []byte("1"), map[string]string{"k": "v"}); err != nil {
+		t.Fatal("Failed to publish:", err)
+	}
+	if len(mqtt.props) != 1 || mqtt.props[0]["k"] != "v" {
+		t.Error("Unexpected published properties:", mqtt.props)
+	}
+}
+
+func TestServiceClient_StartDeviceUpdatesCtx(t *testing.T) {
+	mqtt := newFakeMQTT()
+	mqtt.subscribeBlock = make(chan struct{})
+	defer close(mqtt.subscribeBlock)
+	c := newTestServiceClient(mqtt)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.StartDeviceUpdatesCtx(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected DeadlineExceeded, but got:", err)
+	}
+
+	// the canceled start must be rolled back completely
+	mqtt.lock.Lock()
+	mqtt.subscribeBlock = nil
+	_, subscribed := mqtt.handlers[testServiceEventsTopic]
+	mqtt.lock.Unlock()
+	if subscribed {
+		t.Error("The events topic is still subscribed")
+	}
+	if _, err := c.StartDeviceUpdates(); err != nil {
+		t.Fatal("Failed to restart device updates:", err)
+	}
+	c.StopDeviceUpdates()
+}
+
+func TestServiceClient_PublishDeviceSnapshot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"d1","config":[{"key":"a","value":"1"}]},{"id":"d2","config":[]}]`))
+	}))
+	defer server.Close()
+
+	var node rest.ServiceNode
+	node.ID = "s1"
+	mqtt := newFakeMQTT()
+	c := framework.NewServiceClientWith(node, mqtt, rest.NewHost(server.URL))
+
+	if err := c.PublishDeviceSnapshot("snapshot/all"); !errors.Is(err, framework.ErrInvalidTopic) {
+		t.Error("Expected ErrInvalidTopic, but got:", err)
+	}
+	if err := c.PublishDeviceSnapshot("snapshot/" + framework.DeviceIDPlaceholder + "/config"); err != nil {
+		t.Fatal("Failed to publish snapshot:", err)
+	}
+
+	mqtt.lock.Lock()
+	defer mqtt.lock.Unlock()
+	if len(mqtt.published) != 2 {
+		t.Fatal("Unexpected published messages:", mqtt.published)
+	}
+	for i, id := range []string{"d1", "d2"} {
+		msg := mqtt.published[i]
+		var device rest.ServiceDeviceListItem
+		if err := json.Unmarshal(msg.payload, &device); err != nil || device.Id != id {
+			t.Error("Unexpected snapshot payload:", string(msg.payload))
+		}
+		if msg.topic != "snapshot/"+id+"/config" || !msg.retained {
+			t.Error("Unexpected snapshot message:", msg)
+		}
+	}
+}
+
+func TestServiceClient_WatchDevices(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"d1","config":[{"key":"a","value":"1"}]},{"id":"d2","config":[]}]`))
+	}))
+	defer server.Close()
+
+	var node rest.ServiceNode
+	node.ID = "s1"
+	node.Pubsub.TopicEvents = testServiceEventsTopic
+	mqtt := newFakeMQTT()
+	c := framework.NewServiceClientWith(node, mqtt, rest.NewHost(server.URL))
+
+	events := make(chan string, 10)
+	stop, done, err := c.WatchDevices(framework.WatchHandlers{
+		OnAdd:    func(id string, config map[string]string) { events <- "add " + id },
+		OnUpdate: func(id string, config map[string]string) { events <- "update " + id + " " + config["a"] },
+		OnRemove: func(id string) { events <- "remove " + id },
+	})
+	if err != nil {
+		t.Fatal("Failed to watch devices:", err)
+	}
+
+	event := func(action, id, value string) []byte {
+		return []byte(`{"action":"` + action + `","thing":{"id":"` + id + `","config":[{"key":"a","value":"` + value + `"}]}}`)
+	}
+	mqtt.deliver(testServiceEventsTopic, event("new", "d1", "1"))
+	mqtt.deliver(testServiceEventsTopic, event("update", "d1", "2"))
+	mqtt.deliver(testServiceEventsTopic, event("delete", "d2", ""))
+	mqtt.deliver(testServiceEventsTopic, event("delete", "d3", ""))
+	mqtt.deliver(testServiceEventsTopic, event("update", "d3", "3"))
+
+	expected := []string{"add d1", "add d2", "update d1 2", "remove d2", "add d3"}
+	for _, e := range expected {
+		select {
+		case got := <-events:
+			if got != e {
+				t.Errorf("Expected event %q, but got %q", e, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for event %q", e)
+		}
+	}
+
+	stop()
+	<-done
+	if len(events) != 0 {
+		t.Error("Unexpected extra event:", <-events)
+	}
+}
+
+func TestServiceClient_Compressed(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+	topic := testServiceTopic + "/snapshot"
+
+	var received []string
+	var failed int
+	err := c.SubscribeCompressed(topic, func(topic string, payload []byte) {
+		received = append(received, string(payload))
+	}, func(topic string, payload []byte, err error) {
+		failed++
+	})
+	if err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+
+	if err := c.PublishCompressed(topic, []byte(`{"a":1}`)); err != nil {
+		t.Fatal("Failed to publish:", err)
+	}
+	mqtt.lock.Lock()
+	compressed := mqtt.published[0].payload
+	mqtt.lock.Unlock()
+	if !framework.IsCompressed(compressed) {
+		t.Error("Published payload is not compressed")
+	}
+
+	mqtt.deliver(topic, compressed)
+	mqtt.deliver(topic, []byte(`{"b":2}`))
+	mqtt.deliver(topic, []byte{0x1f, 0x8b, 0})
+	if len(received) != 2 || received[0] != `{"a":1}` || received[1] != `{"b":2}` {
+		t.Error("Unexpected received payloads:", received)
+	}
+	if failed != 1 {
+		t.Error("Expected one payload to fail decompressing, but got", failed)
+	}
+}
+
+func TestServiceClient_DeviceUpdatesFilter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"d1","config":[{"key":"a","value":"x1"}]},{"id":"d2","config":[{"key":"a","value":"y"}]}]`))
+	}))
+	defer server.Close()
+
+	var node rest.ServiceNode
+	node.ID = "s1"
+	node.Pubsub.TopicEvents = testServiceEventsTopic
+	mqtt := newFakeMQTT()
+	c := framework.NewServiceClientWith(node, mqtt, rest.NewHost(server.URL),
+		framework.WithDeviceUpdatesFilter(func(config map[string]string) bool {
+			return strings.HasPrefix(config["a"], "x")
+		}))
+
+	updates, err := c.StartDeviceUpdatesSimple()
+	if err != nil {
+		t.Fatal("Failed to start device updates:", err)
+	}
+	defer c.StopDeviceUpdates()
+
+	event := func(action, id, value string) []byte {
+		return []byte(`{"action":"` + action + `","thing":{"id":"` + id + `","config":[{"key":"a","value":"` + value + `"}]}}`)
+	}
+	go func() {
+		mqtt.deliver(testServiceEventsTopic, event("update", "d2", "x2"))
+		mqtt.deliver(testServiceEventsTopic, event("update", "d2", "x3"))
+		mqtt.deliver(testServiceEventsTopic, event("update", "d1", "y"))
+		mqtt.deliver(testServiceEventsTopic, event("delete", "d1", ""))
+		mqtt.deliver(testServiceEventsTopic, event("new", "d3", "x3"))
+	}()
+
+	expected := []string{"Add d1", "Add d2", "Update d2", "Remove d1", "Add d3"}
+	for _, e := range expected {
+		select {
+		case update := <-updates:
+			if got := update.Type.String() + " " + update.Id; got != e {
+				t.Errorf("Expected update %q, but got %q", e, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for update %q", e)
+		}
+	}
+}
+
+func TestServiceClient_ProbeDeviceUpdatesACL(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+
+	probes, err := c.ProbeDeviceUpdatesACL(50 * time.Millisecond)
+	if err != nil {
+		t.Fatal("Failed to probe:", err)
+	}
+	if len(probes) != 1 || probes[0].Topic != testServiceEventsTopic || probes[0].Delivered {
+		t.Error("Expected the deaf events topic to be reported, but got:", probes)
+	}
+
+	mqtt.lock.Lock()
+	lateProbe := mqtt.published[0].payload
+	mqtt.loopback = true
+	mqtt.lock.Unlock()
+	probes, err = c.ProbeDeviceUpdatesACL(5 * time.Second)
+	if err != nil {
+		t.Fatal("Failed to probe:", err)
+	}
+	if len(probes) != 1 || !probes[0].Delivered {
+		t.Error("Expected the events topic to be delivered, but got:", probes)
+	}
+
+	updates, err := c.StartDeviceUpdates()
+	if err != nil {
+		t.Fatal("Failed to start device updates:", err)
+	}
+	defer c.StopDeviceUpdates()
+
+	// only the late probe of this client is ignored
+	mqtt.deliver(testServiceEventsTopic, lateProbe)
+	mqtt.deliver(testServiceEventsTopic, []byte(`{"action":"aclprobe","nonce":"other"}`))
+	mqtt.deliver(testServiceEventsTopic, []byte(`{"action":"new","thing":{"id":"d1","config":[{"key":"k","value":"\"action\":\"aclprobe\""}]}}`))
+	expected := []framework.DeviceUpdateType{framework.DeviceUpdateTypeErr, framework.DeviceUpdateTypeAdd}
+	for _, e := range expected {
+		select {
+		case update := <-updates:
+			if update.Type != e {
+				t.Errorf("Expected a %v update, but got: %v", e, update)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a %v update", e)
+		}
+	}
+	if _, err := c.ProbeDeviceUpdatesACL(time.Millisecond); err != framework.ErrDeviceUpdatesAlreadyStarted {
+		t.Error("Expected ErrDeviceUpdatesAlreadyStarted, but got:", err)
+	}
+}
+
+func TestServiceClient_WaitForSnapshot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"d1","config":[]},{"id":"d2","config":[]}]`))
+	}))
+	defer server.Close()
+
+	var node rest.ServiceNode
+	node.ID = "s1"
+	node.Pubsub.TopicEvents = testServiceEventsTopic
+	c := framework.NewServiceClientWith(node, newFakeMQTT(), rest.NewHost(server.URL))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := c.WaitForSnapshot(ctx); err != framework.ErrDeviceUpdatesNotStarted {
+		t.Error("Unexpected error before start:", err)
+	}
+
+	// stopping while the snapshot is undelivered must release the waiters
+	if _, err := c.StartDeviceUpdatesSimple(); err != nil {
+		t.Fatal("Failed to start device updates:", err)
+	}
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- c.WaitForSnapshot(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	c.StopDeviceUpdates()
+	if err := <-waitErr; err != framework.ErrSnapshotAborted && err != framework.ErrDeviceUpdatesNotStarted {
+		t.Error("Unexpected error for an aborted snapshot:", err)
+	}
+	if err := c.WaitForSnapshot(ctx); err != framework.ErrDeviceUpdatesNotStarted {
+		t.Error("Unexpected error after stop:", err)
+	}
+
+	// a restart must deliver a fresh snapshot
+	updates, err := c.StartDeviceUpdatesSimple()
+	if err != nil {
+		t.Fatal("Failed to restart device updates:", err)
+	}
+	<-updates
+	<-updates
+	if err := c.WaitForSnapshot(ctx); err != nil {
+		t.Error("Unexpected error after reading the snapshot:", err)
+	}
+	c.StopDeviceUpdates()
+
+	if err := c.StartDeviceUpdatesHandler(func(framework.DeviceUpdate) {}); err != nil {
+		t.Fatal("Failed to start device updates handler:", err)
+	}
+	if err := c.WaitForSnapshot(ctx); err != nil {
+		t.Error("Unexpected error for a handler:", err)
+	}
+	c.StopDeviceUpdates()
+}
+
+func TestServiceClient_Heartbeat(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+	topic := testServiceTopic + "/heartbeat"
+
+	heartbeats := func() int {
+		mqtt.lock.Lock()
+		defer mqtt.lock.Unlock()
+		count := 0
+		for _, msg := range mqtt.published {
+			var heartbeat struct {
+				Timestamp time.Time `json:"timestamp"`
+			}
+			if msg.topic == topic && json.Unmarshal(msg.payload, &heartbeat) == nil && !heartbeat.Timestamp.IsZero() {
+				count++
+			}
+		}
+		return count
+	}
+
+	if err := c.StartHeartbeat(0, ""); err != framework.ErrInvalidHeartbeatInterval {
+		t.Error("Expected ErrInvalidHeartbeatInterval, but got:", err)
+	}
+	if err := c.StartHeartbeat(time.Millisecond, ""); err != nil {
+		t.Fatal("Failed to start heartbeat:", err)
+	}
+	if err := c.StartHeartbeat(time.Millisecond, ""); err != framework.ErrHeartbeatAlreadyStarted {
+		t.Error("Expected ErrHeartbeatAlreadyStarted, but got:", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for heartbeats() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if heartbeats() < 3 {
+		t.Fatal("Heartbeats were not published")
+	}
+
+	// the heartbeat ends with the client
+	c.StopClient()
+	count := heartbeats()
+	time.Sleep(10 * time.Millisecond)
+	if heartbeats() != count {
+		t.Error("Heartbeats were published after StopClient")
+	}
+}
+
+func TestServiceClient_StartPropertyUpdates(t *testing.T) {
+	mqtt := newFakeMQTT()
+	var node rest.ServiceNode
+	node.ID = "592880c57d6ec25f901d9668"
+	node.Pubsub.Topic = testServiceTopic
+	node.Properties = map[string]string{"flag": "off", "old": "1"}
+	node.Version = 2
+	c := framework.NewServiceClientWith(node, mqtt, rest.NewHost(""))
+	topic := testServiceTopic + "/properties"
+
+	updates, err := c.StartPropertyUpdates()
+	if err != nil {
+		t.Fatal("Failed to start property updates:", err)
+	}
+	if _, err := c.StartPropertyUpdates(); err != framework.ErrPropertyUpdatesAlreadyStarted {
+		t.Error("Expected ErrPropertyUpdatesAlreadyStarted, but got:", err)
+	}
+
+	// outdated announcements are ignored
+	mqtt.deliver(topic, []byte(`{"properties":{"flag":"stale"},"__v":1}`))
+	mqtt.deliver(topic, []byte(`{"properties":{"flag":"on","new":"2"},"__v":3}`))
+	expected := []framework.PropertyUpdate{
+		{Key: "flag", Value: "on"},
+		{Key: "new", Value: "2"},
+		{Key: "old", Removed: true},
+	}
+	for _, e := range expected {
+		if update := <-updates; update != e {
+			t.Errorf("Unexpected property update %+v, expected %+v", update, e)
+		}
+	}
+	if value := c.GetProperty("flag"); value != "on" {
+		t.Error("Property was not refreshed:", value)
+	}
+
+	c.StopPropertyUpdates()
+	for range updates {
+	}
+	c.StopPropertyUpdates()
+}
+
+func TestServiceClient_Close(t *testing.T) {
+	mqtt := newFakeMQTT()
+	mqtt.publishBlock = make(chan struct{})
+	c := newTestServiceClient(mqtt, framework.WithCloseTimeout(10*time.Millisecond))
+
+	if err := c.Subscribe(testServiceTopic+"/a", func(string, []byte) {}); err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	c.PublishCallback(testServiceTopic+"/b", []byte("pending"), nil)
+
+	// the pending publish never completes
+	if err := c.Close(); err != framework.ErrFlushTimeout {
+		t.Error("Expected ErrFlushTimeout, but got:", err)
+	}
+	mqtt.lock.Lock()
+	subscribed := len(mqtt.handlers)
+	mqtt.lock.Unlock()
+	if subscribed != 0 {
+		t.Error("Subscriptions were left after Close:", subscribed)
+	}
+	close(mqtt.publishBlock)
+
+	var nilClient *framework.ServiceClient
+	if err := nilClient.Close(); err != nil {
+		t.Error("Unexpected error closing a nil client:", err)
+	}
+}
+
+func TestServiceClient_StopClientGraceful(t *testing.T) {
+	mqtt := newFakeMQTT()
+	mqtt.publishBlock = make(chan struct{})
+	c := newTestServiceClient(mqtt)
+
+	updates, err := c.StartDeviceUpdates()
+	if err != nil {
+		t.Fatal("Failed to start device updates:", err)
+	}
+	if err := c.Subscribe(testServiceTopic+"/a", func(string, []byte) {}); err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+	published := make(chan error, 1)
+	c.PublishCallback(testServiceTopic+"/b", []byte("last"), func(err error) { published <- err })
+
+	// the pending publish completes during the quiesce time
+	time.AfterFunc(10*time.Millisecond, func() { close(mqtt.publishBlock) })
+	if err := c.StopClientGraceful(time.Second); err != nil {
+		t.Fatal("Unexpected error stopping:", err)
+	}
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Error("Pending publish failed:", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Pending publish was not flushed")
+	}
+	if _, ok := <-updates; ok {
+		t.Error("Device updates channel was not closed")
+	}
+	mqtt.lock.Lock()
+	subscribed := len(mqtt.handlers)
+	mqtt.lock.Unlock()
+	if subscribed != 0 {
+		t.Error("Subscriptions were left after StopClientGraceful:", subscribed)
+	}
+
+	// stopping again does nothing
+	if err := c.StopClientGraceful(time.Second); err != nil {
+		t.Error("Unexpected error stopping twice:", err)
+	}
+	c.StopClient()
+}
+
+func TestServiceClient_SetLogger(t *testing.T) {
+	mqtt := newFakeMQTT()
+	var buf bytes.Buffer
+	c := newTestServiceClient(mqtt, framework.WithLogger(log.New(&buf, "", 0)))
+	topic := testServiceTopic + "/properties"
+
+	updates, err := c.StartPropertyUpdates()
+	if err != nil {
+		t.Fatal("Failed to start property updates:", err)
+	}
+	defer func() {
+		c.StopPropertyUpdates()
+		for range updates {
+		}
+	}()
+
+	mqtt.deliver(topic, []byte("garbage"))
+	if !strings.Contains(buf.String(), "Failed to parse service properties update") {
+		t.Errorf("Failure was not logged to the given logger: %q", buf.String())
+	}
+
+	// a nil logger silences the client
+	buf.Reset()
+	c.SetLogger(nil)
+	mqtt.deliver(topic, []byte("garbage"))
+	if buf.Len() != 0 {
+		t.Errorf("Silenced client logged: %q", buf.String())
+	}
+}
+
+func TestServiceClient_ConcurrentProperties(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+	updates, err := c.StartPropertyUpdates()
+	if err != nil {
+		t.Fatal("Failed to start property updates:", err)
+	}
+	go func() {
+		for range updates {
+		}
+	}()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.GetProperty("flag")
+				c.GetProperties()["flag"] = "local"
+				c.Name()
+				c.Node()
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		payload := fmt.Sprintf(`{"properties":{"flag":"%d"},"__v":%d}`, i, i)
+		mqtt.deliver(testServiceTopic+"/properties", []byte(payload))
+	}
+	close(stop)
+	wg.Wait()
+	c.StopPropertyUpdates()
+
+	if value := c.GetProperty("flag"); value != "99" {
+		t.Error("Unexpected property value:", value)
+	}
+}
+
+func TestServiceClient_RefreshServiceInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"s1","name":"renamed","properties":{"flag":"on"},
+			"pubsub":{"protocol":"MQTT","endpoint":"moved"},"__v":5}`))
+	}))
+	defer server.Close()
+
+	mqtt := newFakeMQTT()
+	var node rest.ServiceNode
+	node.ID = "s1"
+	node.Pubsub.Topic = testServiceTopic
+	node.Properties = map[string]string{"flag": "off"}
+	c := framework.NewServiceClientWith(node, mqtt, rest.NewHost(server.URL))
+	if err := c.Subscribe(testServiceTopic+"/a", func(string, []byte) {}); err != nil {
+		t.Fatal("Failed to subscribe:", err)
+	}
+
+	if err := c.RefreshServiceInfo(); err != nil {
+		t.Fatal("Failed to refresh service info:", err)
+	}
+	if c.GetProperty("flag") != "on" || c.Name() != "renamed" || c.Version() != 5 {
+		t.Error("Service info was not refreshed:", c.Node())
+	}
+	// the pubsub endpoint and subscriptions are kept
+	if c.Topic() != testServiceTopic {
+		t.Error("Service topic changed on refresh:", c.Topic())
+	}
+	mqtt.lock.Lock()
+	_, subscribed := mqtt.handlers[testServiceTopic+"/a"]
+	mqtt.lock.Unlock()
+	if !subscribed {
+		t.Error("Subscription was disturbed by the refresh")
+	}
+}
+
+func TestStartClient_TLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "framework-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = framework.StartUserClient("http://localhost", "ssl://localhost:8883", "user", "token",
+		framework.WithTLSFiles(caFile, "", ""))
+	if !errors.Is(err, framework.ErrNoCACertificates) {
+		t.Fatalf("Expected ErrNoCACertificates, got %v", err)
+	}
+
+	_, err = framework.StartUserClient("http://localhost", "ssl://localhost:8883", "user", "token",
+		framework.WithTLSFiles(filepath.Join(dir, "missing.pem"), "", ""))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected a missing file error, got %v", err)
+	}
+}
+
+func TestServiceClient_QoS(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+
+	callback := func(topic string, payload []byte) {}
+	if err := c.SubscribeQoS("config", 2, callback); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SubscribeQoS("telemetry", 0, callback); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PublishQoS("telemetry", 0, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PublishQoS("config", 2, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	mqtt.lock.Lock()
+	defer mqtt.lock.Unlock()
+	if qos := mqtt.subscribedQoS["config"]; qos != 2 {
+		t.Errorf("Expected config to be subscribed at QoS 2, got %d", qos)
+	}
+	if qos := mqtt.subscribedQoS["telemetry"]; qos != 0 {
+		t.Errorf("Expected telemetry to be subscribed at QoS 0, got %d", qos)
+	}
+	if len(mqtt.published) != 2 || mqtt.published[0].qos != 0 || mqtt.published[1].qos != 2 {
+		t.Errorf("Expected publishes at QoS 0 and 2, got %+v", mqtt.published)
+	}
+
+	if err := c.SubscribeQoS("config", 3, callback); !errors.Is(err, framework.ErrInvalidQoS) {
+		t.Errorf("Expected ErrInvalidQoS, got %v", err)
+	}
+	if err := c.PublishQoS("config", 3, []byte("3")); !errors.Is(err, framework.ErrInvalidQoS) {
+		t.Errorf("Expected ErrInvalidQoS, got %v", err)
+	}
+}
+
+func TestServiceClient_PublishRetained(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+
+	if err := c.PublishRetained("status", []byte("online")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish("status", []byte("busy")); err != nil {
+		t.Fatal(err)
+	}
+
+	mqtt.lock.Lock()
+	defer mqtt.lock.Unlock()
+	if len(mqtt.published) != 2 {
+		t.Fatalf("Expected 2 publishes, got %d", len(mqtt.published))
+	}
+	if !mqtt.published[0].retained {
+		t.Error("Expected PublishRetained to publish a retained message")
+	}
+	if mqtt.published[1].retained {
+		t.Error("Expected Publish to publish a non-retained message")
+	}
+}
+
+func TestServiceClient_UnsubscribeAll(t *testing.T) {
+	mqtt := newFakeMQTT()
+	c := newTestServiceClient(mqtt)
+
+	callback := func(topic string, payload []byte) {}
+	for _, topic := range []string{"b", "a", "c"} {
+		if err := c.Subscribe(topic, callback); err != nil {
+			t.Fatal("Failed to subscribe:", err)
+		}
+	}
+	if err := c.Unsubscribe("c"); err != nil {
+		t.Fatal("Failed to unsubscribe:", err)
+	}
+	if topics := c.ActiveSubscriptions(); strings.Join(topics, ",") != "a,b" {
+		t.Errorf("Expected subscriptions a,b, got %v", topics)
+	}
+
+	if err := c.UnsubscribeAll(); err != nil {
+		t.Fatal("Failed to unsubscribe all:", err)
+	}
+	if topics := c.ActiveSubscriptions(); len(topics) != 0 {
+		t.Errorf("Expected no subscriptions, got %v", topics)
+	}
+	mqtt.lock.Lock()
+	subscribed := len(mqtt.handlers)
+	mqtt.lock.Unlock()
+	if subscribed != 0 {
+		t.Error("Subscriptions were left after UnsubscribeAll:", subscribed)
+	}
+	if err := c.UnsubscribeAll(); err != nil {
+		t.Error("Unexpected error unsubscribing with no subscriptions:", err)
+	}
+}
+
+func TestStartServiceClient_ServiceInfoRetry(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	status := http.StatusUnauthorized
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		w.WriteHeader(status)
+		lock.Unlock()
+	}))
+	defer server.Close()
+	opt := framework.WithServiceInfoRetry(3, time.Millisecond)
+
+	// client errors fail right away
+	_, err := framework.StartServiceClient(server.URL, "", "s1", "wrong", opt)
+	if !errors.Is(err, rest.ErrUnauthorized) {
+		t.Error("Expected ErrUnauthorized, but got:", err)
+	}
+	lock.Lock()
+	if requests != 1 {
+		t.Errorf("Expected 1 request for a client error, got %d", requests)
+	}
+	requests = 0
+	status = http.StatusServiceUnavailable
+	lock.Unlock()
+
+	// server errors are retried
+	if _, err := framework.StartServiceClient(server.URL, "", "s1", "token", opt); err == nil {
+		t.Error("Expected an error from an unavailable server")
+	}
+	lock.Lock()
+	if requests != 3 {
+		t.Errorf("Expected 3 requests for a server error, got %d", requests)
+	}
+	lock.Unlock()
+}
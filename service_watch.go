@@ -0,0 +1,72 @@
+package framework
+
+import "errors"
+
+// WatchHandlers are the callbacks of WatchDevices. Any of them can be nil.
+type WatchHandlers struct {
+	// OnAdd is called for every device that is linked to the service,
+	// including the devices that were already linked at start
+	OnAdd func(deviceid string, config map[string]string)
+	// OnUpdate is called when the config of a known device changes
+	OnUpdate func(deviceid string, config map[string]string)
+	// OnRemove is called when a known device is unlinked from the service
+	OnRemove func(deviceid string)
+	// OnError is called for device updates that could not be received
+	OnError func(err error)
+}
+
+// WatchDevices starts device updates, like RunDeviceUpdates, and maintains
+// the current config of every linked device, in order to call the matching
+// handler for each change. Devices that were already linked at start are
+// reported with OnAdd. Redundant updates, like an add for a device that is
+// already known with the same config, are not reported at all, so handlers
+// do not need to switch on the DeviceUpdate type or deduplicate updates.
+//
+// All handlers are called from a single goroutine, in the order the updates
+// were received. The returned stop and done behave like those of
+// RunDeviceUpdates.
+func (c *ServiceClient) WatchDevices(handlers WatchHandlers) (stop func(), done <-chan struct{}, err error) {
+	devices := make(map[string]map[string]string)
+	return c.RunDeviceUpdates(nil, func(update DeviceUpdate) {
+		config, known := devices[update.Id]
+		switch update.Type {
+		case DeviceUpdateTypeAdd, DeviceUpdateTypeUpd:
+			if known && equalConfigs(config, update.Config) {
+				return
+			}
+			devices[update.Id] = update.Config
+			if !known {
+				if handlers.OnAdd != nil {
+					handlers.OnAdd(update.Id, update.Config)
+				}
+			} else if handlers.OnUpdate != nil {
+				handlers.OnUpdate(update.Id, update.Config)
+			}
+		case DeviceUpdateTypeRem:
+			if !known {
+				return
+			}
+			delete(devices, update.Id)
+			if handlers.OnRemove != nil {
+				handlers.OnRemove(update.Id)
+			}
+		case DeviceUpdateTypeErr:
+			if handlers.OnError != nil {
+				handlers.OnError(errors.New(update.Error()))
+			}
+		}
+	})
+}
+
+// equalConfigs tells if two device configs have the same keys and values
+func equalConfigs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package framework
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrNoCACertificates is returned when the CA file given to WithTLSFiles
+// holds no PEM encoded certificates
+var ErrNoCACertificates = errors.New("No CA certificates found")
+
+// tlsBrokerSchemes are the broker URI schemes that connect over TLS, which
+// must also be accepted by rest.ServiceNode.ValidateMQTTProperties
+var tlsBrokerSchemes = []string{"ssl://", "tls://", "tcps://", "wss://"}
+
+// WithTLSConfig sets the TLS configuration used to connect to a broker over
+// TLS, which is a broker URI with the ssl, tls, tcps, or wss scheme. This
+// allows trusting a private CA and authenticating with a client certificate
+// for mutual TLS. The config is ignored for other brokers.
+// The config is used as given, so it is up to the caller to set
+// InsecureSkipVerify.
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// WithTLSFiles is like WithTLSConfig, but loads the TLS configuration from
+// PEM encoded files when the client is started. The caFile is the CA bundle
+// that the broker's certificate is verified with, instead of the system's
+// CAs. The certFile and keyFile are the client certificate and its key, for
+// mutual TLS. Any of them can be empty to not use them.
+// Failing to load the files fails the start of the client.
+func WithTLSFiles(caFile, certFile, keyFile string) ClientOption {
+	return func(c *Client) {
+		c.tlsFiles = &tlsFiles{ca: caFile, cert: certFile, key: keyFile}
+	}
+}
+
+// WithTLSInsecureSkipVerify disables the verification of the broker's
+// certificate for WithTLSFiles. This is insecure and only meant for testing
+// against a broker with a self-signed certificate.
+func WithTLSInsecureSkipVerify() ClientOption {
+	return func(c *Client) {
+		c.tlsInsecure = true
+	}
+}
+
+// tlsFiles are the files of WithTLSFiles
+type tlsFiles struct {
+	ca, cert, key string
+}
+
+// load builds a TLS configuration from the files
+func (f tlsFiles) load(insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if f.ca != "" {
+		pem, err := ioutil.ReadFile(f.ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w in %s", ErrNoCACertificates, f.ca)
+		}
+	}
+	if f.cert != "" || f.key != "" {
+		cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// loadTLSConfig loads the TLS configuration given by WithTLSFiles, if any
+func (c *Client) loadTLSConfig() error {
+	if c.tlsFiles == nil {
+		return nil
+	}
+	config, err := c.tlsFiles.load(c.tlsInsecure)
+	if err != nil {
+		return fmt.Errorf("Failed to load the MQTT TLS configuration: %w", err)
+	}
+	c.tlsConfig = config
+	return nil
+}
+
+// isTLSBroker tells if the broker URI connects over TLS
+func isTLSBroker(brokeruri string) bool {
+	for _, scheme := range tlsBrokerSchemes {
+		if strings.HasPrefix(strings.ToLower(brokeruri), scheme) {
+			return true
+		}
+	}
+	return false
+}
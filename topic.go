@@ -0,0 +1,71 @@
+package framework
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidTopic is returned (wrapped) for a topic that is not allowed by
+// MQTT
+var ErrInvalidTopic = errors.New("Invalid MQTT topic")
+
+// TopicJoin joins topic segments with single slashes, like
+// TopicJoin("openchirp/device/", "/transducer", "temp") is
+// "openchirp/device/transducer/temp". Slashes around the segments are
+// trimmed and empty segments are skipped, except that a leading slash of the
+// first segment is kept, since it is significant to MQTT.
+func TopicJoin(parts ...string) string {
+	var segments []string
+	leading := len(parts) > 0 && strings.HasPrefix(parts[0], "/")
+	for _, part := range parts {
+		if part = strings.Trim(part, "/"); part != "" {
+			segments = append(segments, part)
+		}
+	}
+	topic := strings.Join(segments, "/")
+	if leading {
+		topic = "/" + topic
+	}
+	return topic
+}
+
+// ValidatePublishTopic checks that topic can be published to. It must not be
+// empty and must not contain wildcards or null characters.
+func ValidatePublishTopic(topic string) error {
+	if err := validateTopicChars(topic); err != nil {
+		return err
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("%w: %q contains a wildcard", ErrInvalidTopic, topic)
+	}
+	return nil
+}
+
+// ValidateTopicFilter checks that filter can be subscribed to. Wildcards must
+// occupy an entire topic level and # may only be the last level.
+func ValidateTopicFilter(filter string) error {
+	if err := validateTopicChars(filter); err != nil {
+		return err
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) != 1 {
+			return fmt.Errorf("%w: %q has a wildcard within a level", ErrInvalidTopic, filter)
+		}
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("%w: %q has # before the last level", ErrInvalidTopic, filter)
+		}
+	}
+	return nil
+}
+
+func validateTopicChars(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("%w: empty topic", ErrInvalidTopic)
+	}
+	if strings.ContainsRune(topic, 0) {
+		return fmt.Errorf("%w: %q contains a null character", ErrInvalidTopic, topic)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package framework_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/openchirp/framework"
+)
+
+func TestTopicJoin(t *testing.T) {
+	tests := []struct {
+		parts    []string
+		expected string
+	}{
+		{[]string{"openchirp/device/", "/transducer", "temp"}, "openchirp/device/transducer/temp"},
+		{[]string{"a", "", "b/"}, "a/b"},
+		{[]string{"/a", "b"}, "/a/b"},
+		{[]string{"a", "#"}, "a/#"},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		if topic := framework.TopicJoin(test.parts...); topic != test.expected {
+			t.Errorf("TopicJoin(%q) = %q, expected %q", test.parts, topic, test.expected)
+		}
+	}
+}
+
+func TestValidateTopics(t *testing.T) {
+	for _, topic := range []string{"", "a/+/b", "a/#", "a/\x00"} {
+		if err := framework.ValidatePublishTopic(topic); !errors.Is(err, framework.ErrInvalidTopic) {
+			t.Errorf("Expected publish topic %q to be invalid, but got: %v", topic, err)
+		}
+	}
+	for _, filter := range []string{"a/+/b", "a/#", "#", "+"} {
+		if err := framework.ValidateTopicFilter(filter); err != nil {
+			t.Errorf("Expected filter %q to be valid, but got: %v", filter, err)
+		}
+	}
+	for _, filter := range []string{"a/b#", "a/#/b", "a+/b"} {
+		if err := framework.ValidateTopicFilter(filter); !errors.Is(err, framework.ErrInvalidTopic) {
+			t.Errorf("Expected filter %q to be invalid, but got: %v", filter, err)
+		}
+	}
+}
@@ -9,9 +9,9 @@ type UserClient struct {
 type UserClientTopicHandler func(client *UserClient, topic string, payload []byte)
 
 // StartUserClient starts the user client management layer
-func StartUserClient(frameworkuri, brokeruri, id, token string) (*UserClient, error) {
+func StartUserClient(frameworkuri, brokeruri, id, token string, opts ...ClientOption) (*UserClient, error) {
 	c := new(UserClient)
-	err := c.startClient(frameworkuri, brokeruri, id, token)
+	err := c.startClient(frameworkuri, brokeruri, id, token, opts)
 	return c, err
 }
 
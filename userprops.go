@@ -0,0 +1,87 @@
+package framework
+
+import (
+	"errors"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ErrUserPropertiesUnsupported is returned when user properties are used with
+// an MQTT client that can not carry them, like the MQTT v3 paho client
+var ErrUserPropertiesUnsupported = errors.New("MQTT client does not support user properties")
+
+// UserPropertiesPublisher is implemented by MQTT v5 capable clients that can
+// attach user properties to a publish
+type UserPropertiesPublisher interface {
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, props map[string]string) MQTT.Token
+}
+
+// UserPropertiesMessage is implemented by messages from MQTT v5 capable
+// clients that carry the user properties they were published with
+type UserPropertiesMessage interface {
+	UserProperties() map[string]string
+}
+
+// ClientTopicPropertiesHandler is a callback for receiving a topic's payload
+// along with the message's user properties
+type ClientTopicPropertiesHandler func(topic string, payload []byte, props map[string]string)
+
+// supportsUserProperties indicates if the underlying MQTT client is v5 capable
+func (c *Client) supportsUserProperties() bool {
+	_, ok := c.mqttClient().(UserPropertiesPublisher)
+	return ok
+}
+
+// publishWithProperties publishes a payload with user properties to a given
+// mqtt topic
+func (c *Client) publishWithProperties(topic string, payload interface{}, props map[string]string) error {
+	publisher, ok := c.mqttClient().(UserPropertiesPublisher)
+	if !ok {
+		return ErrUserPropertiesUnsupported
+	}
+	if err := ValidatePublishTopic(topic); err != nil {
+		return err
+	}
+	token := publisher.PublishWithProperties(topic, c.qos, mqttPersistence, payload, props)
+	token.Wait()
+	return token.Error()
+}
+
+// subscribeWithProperties registers a callback for receiving a given mqtt
+// topic payload along with the message's user properties
+func (c *Client) subscribeWithProperties(topic string, callback ClientTopicPropertiesHandler) error {
+	if !c.supportsUserProperties() {
+		return ErrUserPropertiesUnsupported
+	}
+	return c.subscribeMessage(topic, c.qos, func(message MQTT.Message) {
+		var props map[string]string
+		if m, ok := message.(UserPropertiesMessage); ok {
+			props = m.UserProperties()
+		}
+		callback(message.Topic(), message.Payload(), props)
+	})
+}
+
+// SupportsUserProperties indicates if the underlying MQTT client is v5
+// capable, which is required by PublishWithProperties and
+// SubscribeWithProperties
+func (c *ServiceClient) SupportsUserProperties() bool {
+	return c.supportsUserProperties()
+}
+
+// PublishWithProperties publishes a payload to a given mqtt topic, along with
+// the given user properties.
+// ErrUserPropertiesUnsupported is returned if the MQTT client is not v5
+// capable.
+func (c *ServiceClient) PublishWithProperties(topic string, payload []byte, props map[string]string) error {
+	return c.publishWithProperties(topic, payload, props)
+}
+
+// SubscribeWithProperties registers a callback for receiving a given mqtt
+// topic payload along with the message's user properties. Messages that
+// carry no user properties are delivered with a nil map.
+// ErrUserPropertiesUnsupported is returned if the MQTT client is not v5
+// capable.
+func (c *ServiceClient) SubscribeWithProperties(topic string, callback ClientTopicPropertiesHandler) error {
+	return c.subscribeWithProperties(topic, callback)
+}